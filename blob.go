@@ -0,0 +1,282 @@
+package donut
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/nishikirb/donut/diff"
+	"github.com/nishikirb/donut/store"
+	"github.com/nishikirb/donut/system"
+)
+
+// blobStore keeps the contents applied to the destinations in files named after their sha256 sums,
+// so that what donut last wrote to a destination is known even after the destination is modified.
+// gc removes the blobs no longer referenced by the recorded entries.
+type blobStore struct {
+	dir string
+}
+
+// blobs returns the blob store of the state file. Each state file has its own blobs,
+// so that gc never removes a blob referenced by the state of another config.
+func (a *App) blobs() *blobStore {
+	return blobsOf(a.statePath())
+}
+
+// blobsOf returns the blob store next to the state file.
+func blobsOf(state string) *blobStore {
+	return &blobStore{dir: strings.TrimSuffix(state, filepath.Ext(state)) + ".blobs"}
+}
+
+// path returns the file of the blob of the sum.
+func (b *blobStore) path(sum string) string {
+	return filepath.Join(b.dir, sum[:2], sum)
+}
+
+// Put copies the file into the store, and returns the sum of its content.
+func (b *blobStore) Put(file string) (string, error) {
+	src, err := system.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	if err := system.MkdirAll(b.dir, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(b.dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), src); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	path := b.path(sum)
+	// the blob of the same sum has the same content
+	if _, err := system.Stat(path); err == nil {
+		return sum, nil
+	}
+	if err := system.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	return sum, os.Rename(tmp.Name(), path)
+}
+
+// Get returns the content of the blob of the sum.
+func (b *blobStore) Get(sum string) ([]byte, error) {
+	return system.ReadFile(b.path(sum))
+}
+
+// Restore streams the blob of the sum to the file, keeping the permission of an existing file.
+// The file is left as is if the blob does not match its sum.
+func (b *blobStore) Restore(sum, file string, perm fs.FileMode) error {
+	f, err := system.Open(b.path(sum))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	check := func() error {
+		if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+			return fmt.Errorf("%s: corrupted blob, got %s", b.path(sum), got)
+		}
+		return nil
+	}
+	return system.OverwriteFrom(file, io.TeeReader(f, h), perm, check)
+}
+
+// Remove removes the blob of the sum.
+func (b *blobStore) Remove(sum string) error {
+	return system.Remove(b.path(sum))
+}
+
+// Sums returns the sums of the blobs in the store.
+func (b *blobStore) Sums() ([]string, error) {
+	var sums []string
+	err := filepath.WalkDir(b.dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && len(d.Name()) == sha256.Size*2 {
+			sums = append(sums, d.Name())
+		}
+		return nil
+	})
+	return sums, err
+}
+
+// appliedBlob returns the blob recorded for dst, or "" if there is none.
+func (a *App) appliedBlob(dst string) (string, error) {
+	var be *Entry
+	if err := a.store.Get(store.EntryBucket, dst, &be); err != nil || be == nil {
+		return "", err
+	}
+	return be.Blob, nil
+}
+
+// gc removes the blobs referenced by none of the recorded entries, e.g. after they are replaced by a newer apply
+// or forgotten. The cached sums of the files that no longer exist are deleted too.
+func (a *App) gc(_ context.Context, _ []string, flags *pflag.FlagSet) error {
+	dryRun, _ := flags.GetBool("dry-run")
+
+	keys, err := a.store.Keys(store.EntryBucket)
+	if err != nil {
+		return err
+	}
+	referenced := map[string]bool{}
+	for _, key := range keys {
+		sum, err := a.appliedBlob(key)
+		if err != nil {
+			return err
+		}
+		referenced[sum] = true
+	}
+
+	blobs := a.blobs()
+	sums, err := blobs.Sums()
+	if err != nil {
+		return err
+	}
+	var unreferenced []string
+	for _, sum := range sums {
+		if !referenced[sum] {
+			unreferenced = append(unreferenced, sum)
+		}
+	}
+	if dryRun {
+		for _, sum := range unreferenced {
+			fmt.Fprintf(a.out, "Pending: %s\n", blobs.path(sum))
+		}
+		return nil
+	}
+
+	stale, err := a.staleSums()
+	if err != nil {
+		return err
+	}
+	b := store.NewBatch()
+	for _, path := range stale {
+		b.Delete(store.SumBucket, path)
+	}
+	if err := a.store.Write(b); err != nil {
+		return err
+	}
+
+	for _, sum := range unreferenced {
+		if err := blobs.Remove(sum); err != nil {
+			return err
+		}
+		fmt.Fprintf(a.out, "Deleted: %s\n", blobs.path(sum))
+	}
+	return nil
+}
+
+// diffSinceApply returns the differences between the content last applied to dst and its current content.
+// It is nil if dst has no applied content or has not been modified since.
+func (a *App) diffSinceApply(dst string) ([]byte, error) {
+	sum, err := a.appliedBlob(dst)
+	if err != nil || sum == "" {
+		return nil, err
+	}
+	applied, err := a.blobs().Get(sum)
+	if err != nil {
+		return nil, fmt.Errorf("%s: the applied content is missing: %w", dst, err)
+	}
+	de, err := entryCache.Get(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer de.release()
+	current, err := de.GetContent()
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(applied, current) {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := diff.Unified(&buf,
+		diff.File{Name: dst + " (applied)", Content: applied},
+		diff.File{Name: dst, Content: current},
+		diff.WithContext(a.config.DiffContext),
+		diff.WithColor(a.config.Color && system.IsTerminal(a.out)),
+	); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// restore writes the contents last applied to the destinations at the paths back to them, discarding
+// their changes since the last apply. A directory restores the destinations recorded under it.
+func (a *App) restore(_ context.Context, args []string, _ *pflag.FlagSet) error {
+	paths := make([]string, 0, len(args))
+	for _, arg := range args {
+		path, err := filepath.Abs(arg)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+	keys, err := a.store.Keys(store.EntryBucket)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, key := range keys {
+		if !affected(key, paths) {
+			continue
+		}
+		var be *Entry
+		if err := a.store.Get(store.EntryBucket, key, &be); err != nil {
+			return err
+		}
+		if be == nil || be.Blob == "" {
+			continue
+		}
+		found = true
+
+		// the blobs are named after the sha256 sums of their contents, whatever the hash setting is
+		current, err := sha256File(key)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if hex.EncodeToString(current) == be.Blob {
+			continue
+		}
+		if err := system.MkdirAll(filepath.Dir(key), os.ModePerm); err != nil {
+			return err
+		}
+		if err := a.blobs().Restore(be.Blob, key, be.Mode.Perm()); err != nil {
+			return fmt.Errorf("%s: the applied content cannot be restored: %w", key, err)
+		}
+		fmt.Fprintf(a.out, "Restored: %s\n", key)
+	}
+	if !found {
+		return fmt.Errorf("%s: no applied content recorded", strings.Join(args, " "))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package donut
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Block is the region of a destination file managed by donut, between the begin and end marker lines.
+// The rest of the file is kept as is.
+type Block struct {
+	Begin string
+	End   string
+	// Prepend is true if the block is inserted at the beginning of the file when the markers are missing.
+	Prepend bool
+}
+
+// NewBlock returns a block whose markers are comment lines with the given comment prefix.
+func NewBlock(comment string, prepend bool) *Block {
+	return &Block{
+		Begin:   comment + " BEGIN donut",
+		End:     comment + " END donut",
+		Prepend: prepend,
+	}
+}
+
+// Extract returns the content between the markers, and reports whether the markers were found.
+// A begin marker without the end marker is not a block.
+func (b *Block) Extract(content []byte) ([]byte, bool) {
+	start, end, ok, err := b.find(content)
+	if !ok || err != nil {
+		return nil, false
+	}
+	return content[start:end], true
+}
+
+// Replace returns content whose block is replaced with block.
+// The block is inserted with the markers if they are missing. An error is returned if the begin marker
+// has no end marker, as the block would otherwise be inserted again at every apply.
+func (b *Block) Replace(content, block []byte) ([]byte, error) {
+	block = normalizeBlock(block)
+	start, end, ok, err := b.find(content)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		out := make([]byte, 0, len(content)-(end-start)+len(block))
+		out = append(out, content[:start]...)
+		out = append(out, block...)
+		return append(out, content[end:]...), nil
+	}
+
+	var buf bytes.Buffer
+	if !b.Prepend && len(content) > 0 {
+		buf.Write(content)
+		if content[len(content)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	buf.WriteString(b.Begin + "\n")
+	buf.Write(block)
+	buf.WriteString(b.End + "\n")
+	if b.Prepend {
+		buf.Write(content)
+	}
+	return buf.Bytes(), nil
+}
+
+// Normalize returns the block with a trailing newline, as it is written between the markers.
+func (b *Block) Normalize(block []byte) ([]byte, error) {
+	return normalizeBlock(block), nil
+}
+
+// find returns the offsets of the content between the begin and end marker lines.
+// It returns an error if the begin marker line is not followed by the end marker line.
+func (b *Block) find(content []byte) (start, end int, ok bool, err error) {
+	offset := 0
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		trimmed := string(bytes.TrimRight(line, "\r\n"))
+		switch {
+		case !ok && trimmed == b.Begin:
+			start, ok = offset+len(line), true
+		case ok && trimmed == b.End:
+			return start, offset, true, nil
+		}
+		offset += len(line)
+	}
+	if ok {
+		return 0, 0, false, fmt.Errorf("%q has no matching %q", b.Begin, b.End)
+	}
+	return 0, 0, false, nil
+}
+
+// normalizeBlock ensures that the non-empty block ends with a newline, so that the end marker is on its own line.
+func normalizeBlock(block []byte) []byte {
+	if len(block) > 0 && block[len(block)-1] != '\n' {
+		return append(bytes.Clone(block), '\n')
+	}
+	return block
+}
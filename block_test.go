@@ -0,0 +1,66 @@
+package donut
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlock_Replace(t *testing.T) {
+	tests := []struct {
+		name    string
+		block   *Block
+		content string
+		source  string
+		want    string
+	}{
+		{
+			name:    "OK/Replace",
+			block:   NewBlock("#", false),
+			content: "before\n# BEGIN donut\nold\n# END donut\nafter\n",
+			source:  "new\n",
+			want:    "before\n# BEGIN donut\nnew\n# END donut\nafter\n",
+		},
+		{
+			name:    "OK/Append",
+			block:   NewBlock("#", false),
+			content: "before",
+			source:  "new",
+			want:    "before\n# BEGIN donut\nnew\n# END donut\n",
+		},
+		{
+			name:    "OK/Prepend",
+			block:   NewBlock(`"`, true),
+			content: "after\n",
+			source:  "new\n",
+			want:    "\" BEGIN donut\nnew\n\" END donut\nafter\n",
+		},
+		{
+			name:    "OK/Empty",
+			block:   NewBlock("#", false),
+			content: "",
+			source:  "new\n",
+			want:    "# BEGIN donut\nnew\n# END donut\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.block.Replace([]byte(tt.content), []byte(tt.source))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+			block, ok := tt.block.Extract(got)
+			assert.True(t, ok)
+			assert.Equal(t, normalizeBlock([]byte(tt.source)), block)
+		})
+	}
+}
+
+func TestBlock_Replace_Unterminated(t *testing.T) {
+	b := NewBlock("#", false)
+	content := []byte("before\n# BEGIN donut\nold\nafter\n")
+
+	_, err := b.Replace(content, []byte("new\n"))
+	assert.ErrorContains(t, err, `"# BEGIN donut" has no matching "# END donut"`)
+	_, ok := b.Extract(content)
+	assert.False(t, ok)
+}
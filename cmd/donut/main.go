@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -12,8 +19,14 @@ import (
 )
 
 var file string
+var state string
+var wait bool
+var rehash bool
 var verbose bool
 
+// manualMigration is the annotation of the commands that open the store without applying the migrations.
+const manualMigration = "donut/manual-migration"
+
 func main() {
 	app := donut.NewApp()
 	root := NewCmdRoot(app)
@@ -22,36 +35,59 @@ func main() {
 		NewCmdInit(app),
 		NewCmdList(app),
 		NewCmdDiff(app),
+		NewCmdCheck(app),
 		NewCmdMerge(app),
 		NewCmdWhere(app),
 		NewCmdConfig(app),
 		NewCmdApply(app),
 		NewCmdClean(app),
+		NewCmdGC(app),
+		NewCmdRestore(app),
+		NewCmdWatch(app),
+		NewCmdState(app),
 	)
 
-	if err := root.Execute(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := root.ExecuteContext(ctx)
+	stop()
+	if err != nil {
+		// differences are reported by the exit status only
+		if !errors.Is(err, donut.ErrDiffFound) {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
 		os.Exit(1)
 	}
 }
 
 func NewCmdRoot(app *donut.App, _ ...donut.Option) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:          "donut",
-		Version:      donut.GetVersion(),
-		Short:        "Tiny dotfiles management tool",
-		SilenceUsage: true,
+		Use:           "donut",
+		Version:       donut.GetVersion(),
+		Short:         "Tiny dotfiles management tool",
+		SilenceUsage:  true,
+		SilenceErrors: true,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			if err := store.Init(store.DefaultDBFile()); err != nil {
-				return err
-			} else {
-				logger.Init(os.Stdout, verbose)
-				cobra.OnFinalize(func() { store.Close() })
+			logger.Init(os.Stdout, verbose)
+			if state != "" {
+				app.AddOptions(donut.WithStateFile(state))
+			}
+			if wait {
+				app.AddOptions(donut.WithWait())
+			}
+			if rehash {
+				app.AddOptions(donut.WithRehash())
+			}
+			if _, ok := cmd.Annotations[manualMigration]; ok {
+				app.AddOptions(donut.WithStoreOptions(store.WithManualMigration()))
 			}
 			return nil
 		},
 	}
 
 	cmd.PersistentFlags().StringVarP(&file, "file", "f", "", "Specify the configuration file")
+	cmd.PersistentFlags().StringVar(&state, "state", "", "Specify the state file, which is derived from the configuration file by default")
+	cmd.PersistentFlags().BoolVar(&wait, "wait", false, "Wait for the state lock held by another donut process instead of failing")
+	cmd.PersistentFlags().BoolVar(&rehash, "rehash", false, "Hash all the files instead of reusing the sums of the unchanged files")
 	cmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose output")
 
 	return cmd
@@ -80,7 +116,7 @@ func NewCmdList(app *donut.App) *cobra.Command {
 }
 
 func NewCmdDiff(app *donut.App) *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "diff",
 		Short: "Display a list of differences between source and destination files",
 		Args:  cobra.NoArgs,
@@ -90,10 +126,29 @@ func NewCmdDiff(app *donut.App) *cobra.Command {
 		},
 		RunE: run(app),
 	}
+
+	cmd.Flags().Bool("no-pager", false, "Write the differences to stdout without the pager")
+	cmd.Flags().Bool("exit-code", false, "Exit with status 1 if there are differences")
+	cmd.Flags().Bool("since-apply", false, "Display the changes of the destination files since they were last applied")
+
+	return cmd
 }
 
-func NewCmdMerge(app *donut.App) *cobra.Command {
+func NewCmdCheck(app *donut.App) *cobra.Command {
 	return &cobra.Command{
+		Use:   "check",
+		Short: "Display the destination files that differ from the source and exit with status 1 if any",
+		Args:  cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			app.AddOptions(donut.WithConfigLoader(config.WithPath(file)...))
+			return nil
+		},
+		RunE: run(app),
+	}
+}
+
+func NewCmdMerge(app *donut.App) *cobra.Command {
+	cmd := &cobra.Command{
 		Use:   "merge",
 		Short: "Merge the source file into the destination file",
 		Args:  cobra.NoArgs,
@@ -103,6 +158,11 @@ func NewCmdMerge(app *donut.App) *cobra.Command {
 		},
 		RunE: run(app),
 	}
+
+	cmd.Flags().BoolP("batch", "b", false, "Merge all changed files in a single directory merge session")
+	cmd.Flags().Bool("continue-on-error", false, "Continue with the next file when the merge tool fails")
+
+	return cmd
 }
 
 func NewCmdWhere(app *donut.App) *cobra.Command {
@@ -110,7 +170,7 @@ func NewCmdWhere(app *donut.App) *cobra.Command {
 		Use:       "where",
 		Short:     "Display the location of the source or destination directory",
 		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
-		ValidArgs: []string{"source", "destination", "config"},
+		ValidArgs: []string{"source", "destination", "config", "state"},
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			app.AddOptions(donut.WithConfigLoader(config.WithPath(file)...))
 			return nil
@@ -145,6 +205,7 @@ func NewCmdApply(app *donut.App) *cobra.Command {
 	}
 
 	cmd.Flags().BoolP("overwrite", "o", false, "Overwrite the destination file with the source file")
+	cmd.Flags().BoolP("interactive", "i", false, "Ask whether to apply each file")
 
 	return cmd
 }
@@ -162,9 +223,191 @@ func NewCmdClean(app *donut.App) *cobra.Command {
 	}
 }
 
+func NewCmdRestore(app *donut.App) *cobra.Command {
+	return &cobra.Command{
+		Use:   "restore <path>...",
+		Short: "Restore the contents last applied to the destination paths and the paths under them",
+		Args:  cobra.MinimumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			app.AddOptions(donut.WithConfigLoader(config.WithPath(file)...))
+			return nil
+		},
+		RunE: run(app),
+	}
+}
+
+func NewCmdGC(app *donut.App) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Remove the applied contents no longer referenced and the sums of the missing files from the state file",
+		Args:  cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			app.AddOptions(donut.WithConfigLoader(config.WithPath(file)...))
+			return nil
+		},
+		RunE: run(app),
+	}
+
+	cmd.Flags().Bool("dry-run", false, "Display the unreferenced contents without removing them")
+
+	return cmd
+}
+
+func NewCmdWatch(app *donut.App) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Watch the source directory and apply the changed files, or watch the destination files for drift",
+		Args:  cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			app.AddOptions(donut.WithConfigLoader(config.WithPath(file)...))
+			return nil
+		},
+		RunE: run(app),
+	}
+
+	cmd.Flags().BoolP("overwrite", "o", false, "Overwrite the destination file with the source file")
+	cmd.Flags().Duration("delay", 200*time.Millisecond, "Time to wait for further changes before applying")
+	cmd.Flags().Bool("destinations", false, "Watch the applied destination files and report when they drift")
+
+	return cmd
+}
+
+func NewCmdState(app *donut.App) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "state",
+		Short: "Manage the state file of this app",
+		Args:  cobra.NoArgs,
+		// the state file is derived from the configuration file
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := cmd.Root().PersistentPreRunE(cmd, args); err != nil {
+				return err
+			}
+			app.AddOptions(donut.WithConfigLoader(config.WithPath(file)...))
+			return nil
+		},
+	}
+
+	cmd.AddCommand(
+		NewCmdStateMigrate(app),
+		NewCmdStateDump(app),
+		NewCmdStateGet(app),
+		NewCmdStateSet(app),
+		NewCmdStateDelete(app),
+		NewCmdStateForget(app),
+		NewCmdStateExport(app),
+		NewCmdStateImport(app),
+	)
+
+	return cmd
+}
+
+func NewCmdStateMigrate(app *donut.App) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:         "migrate",
+		Short:       "Upgrade the state file to the schema of this version",
+		Args:        cobra.NoArgs,
+		Annotations: map[string]string{manualMigration: ""},
+		RunE:        run(app),
+	}
+
+	cmd.Flags().Bool("dry-run", false, "Display the pending migrations without applying them")
+
+	return cmd
+}
+
+func NewCmdStateDump(app *donut.App) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dump",
+		Short: "Display the recorded states as JSON",
+		Args:  cobra.NoArgs,
+		RunE:  run(app),
+	}
+
+	cmd.Flags().String("bucket", "", fmt.Sprintf("Display only the bucket (%s)", bucketNames()))
+
+	return cmd
+}
+
+func NewCmdStateGet(app *donut.App) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "get <key>",
+		Short: "Display the recorded state of the key as JSON",
+		Args:  cobra.ExactArgs(1),
+		RunE:  run(app),
+	}
+
+	cmd.Flags().String("bucket", store.EntryBucket, fmt.Sprintf("Bucket of the key (%s)", bucketNames()))
+
+	return cmd
+}
+
+func NewCmdStateSet(app *donut.App) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set <key> <json>",
+		Short: "Replace the recorded state of the key with the JSON value",
+		Args:  cobra.ExactArgs(2),
+		RunE:  run(app),
+	}
+
+	cmd.Flags().String("bucket", store.EntryBucket, fmt.Sprintf("Bucket of the key (%s)", bucketNames()))
+
+	return cmd
+}
+
+func NewCmdStateDelete(app *donut.App) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "delete <key>",
+		Short: "Delete the recorded state of the key",
+		Args:  cobra.ExactArgs(1),
+		RunE:  run(app),
+	}
+
+	cmd.Flags().String("bucket", store.EntryBucket, fmt.Sprintf("Bucket of the key (%s)", bucketNames()))
+
+	return cmd
+}
+
+func NewCmdStateForget(app *donut.App) *cobra.Command {
+	return &cobra.Command{
+		Use:   "forget <path>",
+		Short: "Forget the last applied states of the destination path and the paths under it",
+		Args:  cobra.ExactArgs(1),
+		RunE:  run(app),
+	}
+}
+
+func NewCmdStateExport(app *donut.App) *cobra.Command {
+	return &cobra.Command{
+		Use:   "export [file]",
+		Short: "Write the recorded states as JSON to the file or stdout",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  run(app),
+	}
+}
+
+func NewCmdStateImport(app *donut.App) *cobra.Command {
+	return &cobra.Command{
+		Use:   "import [file]",
+		Short: "Record the states exported to the file or stdin",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  run(app),
+	}
+}
+
+// bucketNames lists the buckets of the store for the help of the flags, such as "entries, externals or meta".
+func bucketNames() string {
+	buckets := store.Buckets()
+	if len(buckets) < 2 {
+		return strings.Join(buckets, "")
+	}
+	return strings.Join(buckets[:len(buckets)-1], ", ") + " or " + buckets[len(buckets)-1]
+}
+
+// run runs the handler named by the command path without the root, such as "state migrate".
 func run(app *donut.App) func(cmd *cobra.Command, args []string) error {
 	return func(cmd *cobra.Command, args []string) error {
-		return app.Run(cmd.Context(), cmd.Name(), args, cmd.Flags())
+		name := strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+		return app.Run(cmd.Context(), name, args, cmd.Flags())
 	}
 }
 
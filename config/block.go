@@ -0,0 +1,33 @@
+package config
+
+import (
+	"fmt"
+)
+
+const (
+	BlockPositionAppend  = "append"
+	BlockPositionPrepend = "prepend"
+)
+
+// Block makes donut manage only a marked block of the destination files.
+type Block struct {
+	// Path is a pattern of the source files relative to the source directory.
+	Path string `mapstructure:"path"`
+	// Comment is the comment prefix of the marker lines. The default is "#".
+	Comment string `mapstructure:"comment"`
+	// Position is where the block is inserted when the markers are missing, either "append" or "prepend".
+	// The default is "append".
+	Position string `mapstructure:"position"`
+}
+
+func validateBlock(b Block) error {
+	if b.Path == "" {
+		return fmt.Errorf("blocks: path not defined")
+	}
+	switch b.Position {
+	case "", BlockPositionAppend, BlockPositionPrepend:
+	default:
+		return fmt.Errorf("blocks: %s: unknown position %q", b.Path, b.Position)
+	}
+	return nil
+}
@@ -10,13 +10,24 @@ import (
 )
 
 type Config struct {
-	Source      string   `mapstructure:"source"`
-	Destination string   `mapstructure:"destination"`
-	Excludes    []string `mapstructure:"excludes"`
-	Editor      []string `mapstructure:"editor"`
-	Pager       []string `mapstructure:"pager"`
-	Diff        []string `mapstructure:"diff"`
-	Merge       []string `mapstructure:"merge"`
+	Source      string     `mapstructure:"source"`
+	Destination string     `mapstructure:"destination"`
+	Excludes    []string   `mapstructure:"excludes"`
+	Modes       []Mode     `mapstructure:"modes"`
+	Exact       []string   `mapstructure:"exact"`
+	Blocks      []Block    `mapstructure:"blocks"`
+	Patches     []Patch    `mapstructure:"patches"`
+	Editor      []string   `mapstructure:"editor"`
+	Pager       []string   `mapstructure:"pager"`
+	Diff        []string   `mapstructure:"diff"`
+	DiffContext int        `mapstructure:"diff_context"`
+	Color       bool       `mapstructure:"color"`
+	Merge       []string   `mapstructure:"merge"`
+	MergeBatch  []string   `mapstructure:"merge_batch"`
+	OnDrift     []string   `mapstructure:"on_drift"`
+	Externals   []External `mapstructure:"externals"`
+	State       string     `mapstructure:"state"`
+	Hash        string     `mapstructure:"hash"`
 	Concurrency int
 	File        string
 }
@@ -67,6 +78,29 @@ func validate(c *Config) error {
 			return err
 		}
 	}
+	if err := validateHash(c.Hash); err != nil {
+		return err
+	}
+	for _, m := range c.Modes {
+		if err := validateMode(m); err != nil {
+			return err
+		}
+	}
+	for _, b := range c.Blocks {
+		if err := validateBlock(b); err != nil {
+			return err
+		}
+	}
+	for _, p := range c.Patches {
+		if err := validatePatch(p); err != nil {
+			return err
+		}
+	}
+	for _, e := range c.Externals {
+		if err := validateExternal(e); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
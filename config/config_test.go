@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -30,6 +31,9 @@ func TestNew(t *testing.T) {
 				Editor:      []string{"vim"},
 				Pager:       []string{"less", "-R"},
 				Diff:        []string{"diff", "-upN", "{{.Destination}}", "{{.Source}}"},
+				DiffContext: 3,
+				Color:       true,
+				Hash:        HashSHA256,
 				Merge:       []string{"vimdiff", "{{.Destination}}", "{{.Source}}"},
 			},
 			assertion: assert.NoError,
@@ -50,6 +54,73 @@ func TestNew(t *testing.T) {
 			},
 			assertion: assert.NoError,
 		},
+		{
+			name: "OK/WithData/Modes",
+			opts: []ConfigOption{WithData(map[string]interface{}{
+				"source":      data,
+				"destination": home,
+				"modes": []map[string]interface{}{
+					{"path": ".ssh", "mode": "0700"},
+					{"path": ".gnupg", "mode": 0o700},
+				},
+			})},
+			want: &Config{
+				Source:      data,
+				Destination: home,
+				Modes:       []Mode{{Path: ".ssh", Mode: 0700}, {Path: ".gnupg", Mode: 0700}},
+			},
+			assertion: assert.NoError,
+		},
+		{
+			name: "Error/WithData/Modes",
+			opts: []ConfigOption{WithData(map[string]interface{}{
+				"source":      data,
+				"destination": home,
+				"modes":       []map[string]interface{}{{"path": ".ssh", "mode": "rwx"}},
+			})},
+			want:      nil,
+			assertion: assert.Error,
+		},
+		{
+			name: "OK/WithData/Externals",
+			opts: []ConfigOption{WithData(map[string]interface{}{
+				"source":      data,
+				"destination": home,
+				"externals": []map[string]interface{}{
+					{"url": "https://example.com/plug.vim", "destination": ".vim/autoload/plug.vim", "refresh": "168h", "mode": "0600"},
+				},
+			})},
+			want: &Config{
+				Source:      data,
+				Destination: home,
+				Externals: []External{
+					{URL: "https://example.com/plug.vim", Destination: ".vim/autoload/plug.vim", Refresh: 168 * time.Hour, Mode: 0600},
+				},
+			},
+			assertion: assert.NoError,
+		},
+		{
+			name: "Error/WithData/Externals",
+			opts: []ConfigOption{WithData(map[string]interface{}{
+				"source":      data,
+				"destination": home,
+				"externals": []map[string]interface{}{
+					{"url": "https://example.com/fonts.zip", "destination": "fonts", "type": "unknown"},
+				},
+			})},
+			want:      nil,
+			assertion: assert.Error,
+		},
+		{
+			name: "Error/WithData/Hash",
+			opts: []ConfigOption{WithData(map[string]interface{}{
+				"source":      data,
+				"destination": home,
+				"hash":        "crc32",
+			})},
+			want:      nil,
+			assertion: assert.Error,
+		},
 		{
 			name: "OK/WithNameAndPath",
 			opts: []ConfigOption{WithNameAndPath("basic", "../test/testdata/config")},
@@ -70,6 +141,16 @@ func TestNew(t *testing.T) {
 			},
 			assertion: assert.NoError,
 		},
+		{
+			name: "OK/WithFile/Modes",
+			opts: []ConfigOption{WithFile("../test/testdata/config/modes.toml")},
+			want: &Config{
+				Source:      data,
+				Destination: home,
+				Modes:       []Mode{{Path: ".config/Code", Mode: 0700}, {Path: ".ssh", Mode: 0700}},
+			},
+			assertion: assert.NoError,
+		},
 		{
 			name:      "Error/WithFile/Broken",
 			opts:      []ConfigOption{WithFile("../test/testdata/config/broken.toml")},
@@ -97,6 +178,9 @@ func TestNew(t *testing.T) {
 				Editor:      []string{"nvim"},
 				Pager:       []string{"less", "-R"},
 				Diff:        []string{"diff", "-upN", "{{.Destination}}", "{{.Source}}"},
+				DiffContext: 3,
+				Color:       true,
+				Hash:        HashSHA256,
 				Merge:       []string{"vimdiff", "{{.Destination}}", "{{.Source}}"},
 			},
 			assertion: assert.NoError,
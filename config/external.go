@@ -0,0 +1,46 @@
+package config
+
+import (
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+const (
+	ExternalTypeFile    = "file"
+	ExternalTypeArchive = "archive"
+)
+
+// External is a file or an archive fetched from outside of the source directory.
+type External struct {
+	// URL is a http(s) or file URL, or a local path.
+	URL string `mapstructure:"url"`
+	// SHA256 is the expected checksum of the fetched artifact in hex. It is not verified if empty.
+	SHA256 string `mapstructure:"sha256"`
+	// Type is either "file" or "archive". The default is "file".
+	Type string `mapstructure:"type"`
+	// Destination is the file, or the directory an archive is extracted into.
+	// A relative path is relative to the destination directory.
+	Destination string `mapstructure:"destination"`
+	// Refresh is the period after which the artifact is fetched again. It is never fetched again if zero.
+	Refresh time.Duration `mapstructure:"refresh"`
+	// Mode is the permission of the destination file. The default is 0644.
+	Mode fs.FileMode `mapstructure:"mode"`
+	// StripComponents is the number of leading path elements removed from the archive members.
+	StripComponents int `mapstructure:"strip_components"`
+}
+
+func validateExternal(e External) error {
+	if e.URL == "" {
+		return fmt.Errorf("externals: url not defined")
+	}
+	if e.Destination == "" {
+		return fmt.Errorf("externals: %s: destination not defined", e.URL)
+	}
+	switch e.Type {
+	case "", ExternalTypeFile, ExternalTypeArchive:
+	default:
+		return fmt.Errorf("externals: %s: unknown type %q", e.URL, e.Type)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package config
+
+import (
+	"fmt"
+)
+
+const (
+	HashSHA256 = "sha256"
+	HashSHA512 = "sha512"
+	HashMD5    = "md5"
+	// HashXXH64 is the 64-bit xxHash, a non-cryptographic hash much faster than the others.
+	HashXXH64 = "xxh64"
+)
+
+func validateHash(h string) error {
+	switch h {
+	case "", HashSHA256, HashSHA512, HashMD5, HashXXH64:
+	default:
+		return fmt.Errorf("hash: unknown algorithm %q", h)
+	}
+	return nil
+}
@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/viper"
 )
 
 const AppName string = "donut"
@@ -31,6 +35,51 @@ func DefaultConfigFile() string {
 	return filepath.Join(UserHomeDir, ".config", AppName, fmt.Sprintf("%s.%s", AppName, "toml"))
 }
 
+// IsDefaultFile reports whether path is a config file found without the file specified,
+// that is, a file named donut in one of the default config directories.
+func IsDefaultFile(path string) bool {
+	if strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) != AppName {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(defaultConfigDirs(), func(d string) bool {
+		d, ok := expandDir(d)
+		return ok && d == filepath.Dir(abs)
+	})
+}
+
+// FindDefaultFile returns the config file found without the file specified, if any.
+func FindDefaultFile() (string, bool) {
+	for _, d := range defaultConfigDirs() {
+		d, ok := expandDir(d)
+		if !ok {
+			continue
+		}
+		for _, ext := range viper.SupportedExts {
+			path := filepath.Join(d, AppName+"."+ext)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				return path, true
+			}
+		}
+	}
+	return "", false
+}
+
+// expandDir expands the variables in the config directory d. It reports false if any of them is unset,
+// as the directories of unset variables are not searched.
+func expandDir(d string) (string, bool) {
+	set := true
+	d = os.Expand(d, func(key string) string {
+		v := os.Getenv(key)
+		set = set && v != ""
+		return v
+	})
+	return filepath.Clean(d), set
+}
+
 func defaultConfigDirs() []string {
 	return []string{
 		"$XDG_CONFIG_HOME",
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"io/fs"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/mitchellh/mapstructure"
@@ -10,6 +12,7 @@ import (
 
 var defaultDecodeHookFunc = mapstructure.ComposeDecodeHookFunc(
 	ExpandEnvFunc(),
+	StringToFileModeFunc(),
 	mapstructure.StringToTimeDurationHookFunc(),
 	mapstructure.StringToSliceHookFunc(","),
 )
@@ -29,3 +32,18 @@ func ExpandEnvFunc() mapstructure.DecodeHookFunc {
 		return os.ExpandEnv(raw), nil
 	}
 }
+
+// mapstructure's DecodeHookFunc that parses octal strings such as "0700" into fs.FileMode
+func StringToFileModeFunc() mapstructure.DecodeHookFunc {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String || t != reflect.TypeOf(fs.FileMode(0)) {
+			return data, nil
+		}
+
+		mode, err := strconv.ParseUint(data.(string), 8, 32)
+		if err != nil {
+			return nil, err
+		}
+		return fs.FileMode(mode), nil
+	}
+}
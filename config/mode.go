@@ -0,0 +1,25 @@
+package config
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// Mode sets the permission of the destination directories matching a pattern.
+// It is a table with the pattern as a value rather than a key, as the keys of the config are lowercased.
+type Mode struct {
+	// Path is a pattern of the directories relative to the destination directory.
+	Path string `mapstructure:"path"`
+	// Mode is the permission of the directories, such as "0700".
+	Mode fs.FileMode `mapstructure:"mode"`
+}
+
+func validateMode(m Mode) error {
+	if m.Path == "" {
+		return fmt.Errorf("modes: path not defined")
+	}
+	if m.Mode == 0 {
+		return fmt.Errorf("modes: %s: mode not defined", m.Path)
+	}
+	return nil
+}
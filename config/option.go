@@ -55,6 +55,9 @@ func WithDefault() ConfigOption {
 		v.SetDefault("editor", []string{"vim"})
 		v.SetDefault("pager", []string{"less", "-R"})
 		v.SetDefault("diff", []string{"diff", "-upN", "{{.Destination}}", "{{.Source}}"})
+		v.SetDefault("diff_context", 3)
+		v.SetDefault("color", true)
+		v.SetDefault("hash", HashSHA256)
 		v.SetDefault("merge", []string{"vimdiff", "{{.Destination}}", "{{.Source}}"})
 		return nil
 	}
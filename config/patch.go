@@ -0,0 +1,32 @@
+package config
+
+import (
+	"fmt"
+)
+
+const (
+	PatchFormatJSON = "json"
+	PatchFormatTOML = "toml"
+	PatchFormatYAML = "yaml"
+)
+
+// Patch makes donut deep-merge the source files into the structured documents of the destination files.
+// The keys of the destination that are not in the source are kept as is.
+type Patch struct {
+	// Path is a pattern of the source files relative to the source directory.
+	Path string `mapstructure:"path"`
+	// Format is either "json", "toml" or "yaml". It is detected from the extension of the file if empty.
+	Format string `mapstructure:"format"`
+}
+
+func validatePatch(p Patch) error {
+	if p.Path == "" {
+		return fmt.Errorf("patches: path not defined")
+	}
+	switch p.Format {
+	case "", PatchFormatJSON, PatchFormatTOML, PatchFormatYAML:
+	default:
+		return fmt.Errorf("patches: %s: unknown format %q", p.Path, p.Format)
+	}
+	return nil
+}
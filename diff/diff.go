@@ -0,0 +1,162 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Builtin is the keyword that selects the built-in diff renderer in the config.
+const Builtin = "builtin"
+
+const (
+	colorReset = "\x1b[0m"
+	colorBold  = "\x1b[1m"
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorCyan  = "\x1b[36m"
+)
+
+// binaryCheckSize is the number of leading bytes inspected to detect binary content.
+const binaryCheckSize = 8000
+
+// File is one side of a diff.
+type File struct {
+	Name    string
+	Content []byte
+}
+
+type options struct {
+	context int
+	color   bool
+}
+
+type Option func(o *options)
+
+// WithContext sets the number of context lines around each change.
+func WithContext(n int) Option {
+	return func(o *options) {
+		if n >= 0 {
+			o.context = n
+		}
+	}
+}
+
+// WithColor enables ANSI colored output.
+func WithColor(enabled bool) Option {
+	return func(o *options) {
+		o.color = enabled
+	}
+}
+
+// Unified writes the unified diff between from and to into w.
+// Nothing is written when the contents are equal. A missing file is expected to be
+// passed with empty content, which is compared like `diff -N` does.
+func Unified(w io.Writer, from, to File, opts ...Option) error {
+	o := &options{context: 3}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if bytes.Equal(from.Content, to.Content) {
+		return nil
+	}
+	if isBinary(from.Content) || isBinary(to.Content) {
+		_, err := fmt.Fprintf(w, "Binary files %s and %s differ\n", from.Name, to.Name)
+		return err
+	}
+
+	a, b := splitLines(from.Content), splitLines(to.Content)
+	edits := compute(a, b)
+
+	p := &printer{w: w, color: o.color}
+	p.header("--- "+from.Name, "+++ "+to.Name)
+	for _, h := range hunks(edits, o.context) {
+		p.hunk(h, a, b)
+	}
+	return p.err
+}
+
+// isBinary reports whether the content looks like binary data.
+func isBinary(content []byte) bool {
+	if len(content) > binaryCheckSize {
+		content = content[:binaryCheckSize]
+	}
+	return bytes.IndexByte(content, 0) != -1
+}
+
+// splitLines splits content into lines, keeping the trailing newline of each line.
+func splitLines(content []byte) []string {
+	var lines []string
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n')
+		if i == -1 {
+			lines = append(lines, string(content))
+			break
+		}
+		lines = append(lines, string(content[:i+1]))
+		content = content[i+1:]
+	}
+	return lines
+}
+
+type printer struct {
+	w     io.Writer
+	color bool
+	err   error
+}
+
+func (p *printer) header(from, to string) {
+	p.write(colorBold, from+"\n")
+	p.write(colorBold, to+"\n")
+}
+
+func (p *printer) hunk(h hunk, a, b []string) {
+	p.write(colorCyan, fmt.Sprintf("@@ -%s +%s @@\n", hunkRange(h.fromStart, h.fromLen), hunkRange(h.toStart, h.toLen)))
+	for _, e := range h.edits {
+		switch e.op {
+		case opEqual:
+			p.line("", " ", a[e.from])
+		case opDelete:
+			p.line(colorRed, "-", a[e.from])
+		case opInsert:
+			p.line(colorGreen, "+", b[e.to])
+		}
+	}
+}
+
+func (p *printer) line(color, prefix, line string) {
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		p.write(color, prefix+line)
+		return
+	}
+	p.write(color, prefix+line+"\n")
+	p.write("", "\\ No newline at end of file\n")
+}
+
+func (p *printer) write(color, s string) {
+	if p.err != nil {
+		return
+	}
+	if p.color && color != "" {
+		// keep the newline outside of the escape sequence so that pagers render it cleanly
+		body, nl := s, ""
+		if len(s) > 0 && s[len(s)-1] == '\n' {
+			body, nl = s[:len(s)-1], "\n"
+		}
+		s = color + body + colorReset + nl
+	}
+	_, p.err = io.WriteString(p.w, s)
+}
+
+// hunkRange formats a hunk range in the same way as GNU diff.
+func hunkRange(start, length int) string {
+	switch length {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	default:
+		return fmt.Sprintf("%d,%d", start+1, length)
+	}
+}
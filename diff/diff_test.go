@@ -0,0 +1,136 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name      string
+		from      File
+		to        File
+		opts      []Option
+		want      string
+		assertion assert.ErrorAssertionFunc
+	}{
+		{
+			name:      "OK/Equal",
+			from:      File{Name: "a", Content: []byte("foo\nbar\n")},
+			to:        File{Name: "b", Content: []byte("foo\nbar\n")},
+			want:      "",
+			assertion: assert.NoError,
+		},
+		{
+			name: "OK/Modified",
+			from: File{Name: "a", Content: []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n")},
+			to:   File{Name: "b", Content: []byte("1\n2\n3\n4\nfive\n6\n7\n8\n9\n")},
+			want: "--- a\n+++ b\n" +
+				"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+			assertion: assert.NoError,
+		},
+		{
+			name: "OK/Context",
+			from: File{Name: "a", Content: []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n")},
+			to:   File{Name: "b", Content: []byte("one\n2\n3\n4\n5\n6\n7\n8\nnine\n")},
+			opts: []Option{WithContext(1)},
+			want: "--- a\n+++ b\n" +
+				"@@ -1,2 +1,2 @@\n-1\n+one\n 2\n" +
+				"@@ -8,2 +8,2 @@\n 8\n-9\n+nine\n",
+			assertion: assert.NoError,
+		},
+		{
+			name: "OK/MissingFrom",
+			from: File{Name: "a"},
+			to:   File{Name: "b", Content: []byte("foo\n")},
+			want: "--- a\n+++ b\n" +
+				"@@ -0,0 +1 @@\n+foo\n",
+			assertion: assert.NoError,
+		},
+		{
+			name: "OK/NoNewlineAtEOF",
+			from: File{Name: "a", Content: []byte("foo\nbar")},
+			to:   File{Name: "b", Content: []byte("foo\nbaz\n")},
+			want: "--- a\n+++ b\n" +
+				"@@ -1,2 +1,2 @@\n foo\n-bar\n\\ No newline at end of file\n+baz\n",
+			assertion: assert.NoError,
+		},
+		{
+			name:      "OK/Binary",
+			from:      File{Name: "a", Content: []byte("foo\x00")},
+			to:        File{Name: "b", Content: []byte("bar\x00")},
+			want:      "Binary files a and b differ\n",
+			assertion: assert.NoError,
+		},
+		{
+			name: "OK/Color",
+			from: File{Name: "a", Content: []byte("foo\n")},
+			to:   File{Name: "b", Content: []byte("bar\n")},
+			opts: []Option{WithColor(true)},
+			want: "\x1b[1m--- a\x1b[0m\n\x1b[1m+++ b\x1b[0m\n" +
+				"\x1b[36m@@ -1 +1 @@\x1b[0m\n\x1b[31m-foo\x1b[0m\n\x1b[32m+bar\x1b[0m\n",
+			assertion: assert.NoError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			tt.assertion(t, Unified(w, tt.from, tt.to, tt.opts...))
+			assert.Equal(t, tt.want, w.String())
+		})
+	}
+}
+
+func TestCompute(t *testing.T) {
+	lines := func(prefix string, n int) []string {
+		l := make([]string, n)
+		for i := range l {
+			l[i] = fmt.Sprintf("%s%d", prefix, i)
+		}
+		return l
+	}
+	tests := []struct {
+		name string
+		a, b []string
+	}{
+		{name: "OK/Equal", a: lines("a", 10), b: lines("a", 10)},
+		{name: "OK/Interleaved", a: lines("a", 10), b: append(append(lines("a", 3), "x"), lines("a", 10)[5:]...)},
+		{name: "OK/Large", a: lines("a", 10000), b: lines("b", 10000)},
+		{name: "OK/LargeSurrounded", a: append(append(lines("p", 5), lines("a", 8000)...), "s"), b: append(append(lines("p", 5), lines("b", 8000)...), "s")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the edit script transforms a into b
+			var gotA, gotB []string
+			for _, e := range compute(tt.a, tt.b) {
+				switch e.op {
+				case opEqual:
+					gotA, gotB = append(gotA, tt.a[e.from]), append(gotB, tt.b[e.to])
+				case opDelete:
+					gotA = append(gotA, tt.a[e.from])
+				case opInsert:
+					gotB = append(gotB, tt.b[e.to])
+				}
+			}
+			assert.Equal(t, tt.a, gotA)
+			assert.Equal(t, tt.b, gotB)
+		})
+	}
+}
+
+func TestUnified_Large(t *testing.T) {
+	from, to := &bytes.Buffer{}, &bytes.Buffer{}
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(from, "from %d\n", i)
+		fmt.Fprintf(to, "to %d\n", i)
+	}
+
+	// the inputs differing entirely are diffed as a whole replacement without the search
+	w := &bytes.Buffer{}
+	assert.NoError(t, Unified(w, File{Name: "a", Content: from.Bytes()}, File{Name: "b", Content: to.Bytes()}))
+	assert.Contains(t, w.String(), "@@ -1,20000 +1,20000 @@\n-from 0\n")
+	assert.Contains(t, w.String(), "+to 19999\n")
+}
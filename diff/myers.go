@@ -0,0 +1,200 @@
+package diff
+
+type operation int
+
+const (
+	opEqual operation = iota
+	opDelete
+	opInsert
+)
+
+// edit is a single line operation. from and to are the cursor positions in each
+// side at the time of the operation.
+type edit struct {
+	op   operation
+	from int
+	to   int
+}
+
+type hunk struct {
+	fromStart, fromLen int
+	toStart, toLen     int
+	edits              []edit
+}
+
+// maxCost is the largest number of line edits searched for the shortest edit script.
+// The trace of the search grows with the square of the cost, so inputs differing more
+// are diffed as a whole replacement instead, which keeps large rewrites cheap.
+const maxCost = 2048
+
+// compute returns the shortest edit script that transforms a into b,
+// using the Myers O(ND) algorithm, or a replacement of the whole differing
+// range if it costs more than maxCost edits.
+func compute(a, b []string) []edit {
+	// the common prefix and suffix are equal lines without a search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]edit, 0, len(a)+len(b)-prefix-suffix)
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, edit{op: opEqual, from: i, to: i})
+	}
+	middle := search(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	if middle == nil {
+		middle = replace(len(a)-prefix-suffix, len(b)-prefix-suffix)
+	}
+	for _, e := range middle {
+		edits = append(edits, edit{op: e.op, from: e.from + prefix, to: e.to + prefix})
+	}
+	for i := 0; i < suffix; i++ {
+		edits = append(edits, edit{op: opEqual, from: len(a) - suffix + i, to: len(b) - suffix + i})
+	}
+	return edits
+}
+
+// search returns the shortest edit script that transforms a into b,
+// or nil if it costs more than maxCost edits.
+func search(a, b []string) []edit {
+	n, m := len(a), len(b)
+	total := n + m
+	if total == 0 {
+		return []edit{}
+	}
+	offset := total + 1
+	v := make([]int, 2*total+2)
+	// trace[d] holds the diagonals -d..d of v before the step d
+	var trace [][]int
+
+	for d := 0; d <= total; d++ {
+		if d > maxCost {
+			return nil
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, n, m, d)
+			}
+		}
+	}
+	return nil
+}
+
+// replace returns the edit script deleting all the n lines and inserting all the m lines.
+func replace(n, m int) []edit {
+	edits := make([]edit, 0, n+m)
+	for i := 0; i < n; i++ {
+		edits = append(edits, edit{op: opDelete, from: i, to: 0})
+	}
+	for j := 0; j < m; j++ {
+		edits = append(edits, edit{op: opInsert, from: n, to: j})
+	}
+	return edits
+}
+
+func backtrack(trace [][]int, n, m, depth int) []edit {
+	var edits []edit
+	x, y := n, m
+	for d := depth; d > 0; d-- {
+		at := func(k int) int { return trace[d][k+d] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			edits = append(edits, edit{op: opEqual, from: x, to: y})
+		}
+		if x == prevX {
+			y--
+			edits = append(edits, edit{op: opInsert, from: x, to: y})
+		} else {
+			x--
+			edits = append(edits, edit{op: opDelete, from: x, to: y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		edits = append(edits, edit{op: opEqual, from: x, to: y})
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// hunks groups the edits into hunks with the given number of context lines.
+func hunks(edits []edit, context int) []hunk {
+	var result []hunk
+	i := 0
+	for i < len(edits) {
+		// find the next change
+		for i < len(edits) && edits[i].op == opEqual {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+		start := max(i-context, 0)
+
+		// extend while the gap of equal lines between changes is small enough to merge
+		end := i
+		for end < len(edits) {
+			if edits[end].op != opEqual {
+				end++
+				continue
+			}
+			j := end
+			for j < len(edits) && edits[j].op == opEqual {
+				j++
+			}
+			if j == len(edits) || j-end > 2*context {
+				end = min(end+context, len(edits))
+				break
+			}
+			end = j
+		}
+
+		h := hunk{
+			fromStart: edits[start].from,
+			toStart:   edits[start].to,
+			edits:     edits[start:end],
+		}
+		for _, e := range h.edits {
+			switch e.op {
+			case opEqual:
+				h.fromLen++
+				h.toLen++
+			case opDelete:
+				h.fromLen++
+			case opInsert:
+				h.toLen++
+			}
+		}
+		result = append(result, h)
+		i = end
+	}
+	return result
+}
@@ -0,0 +1,91 @@
+package donut
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/nishikirb/donut/store"
+	"github.com/nishikirb/donut/system"
+)
+
+// dirChanged reports whether the destination directory of pm is missing, or has a different permission
+// from the one set by the modes config. The permission of an existing directory is otherwise kept.
+func dirChanged(pm PathMapping) (bool, error) {
+	de, err := entryCache.Get(pm.Destination)
+	if err != nil {
+		return false, err
+	}
+	return de.Empty || !de.Mode.IsDir() || (pm.ModeSet && de.Mode.Perm() != pm.Mode), nil
+}
+
+// dirDiff describes the difference of the directory mapping pm.
+func dirDiff(pm PathMapping) ([]byte, error) {
+	de, err := entryCache.Get(pm.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "directory %s\n", pm.Destination)
+	switch {
+	case de.Empty:
+	case !de.Mode.IsDir():
+		fmt.Fprintf(&buf, "old type %s\n", de.Mode.Type())
+	case pm.ModeSet && de.Mode.Perm() != pm.Mode:
+		fmt.Fprintf(&buf, "old mode %04o\n", de.Mode.Perm())
+	default:
+		return nil, nil
+	}
+	fmt.Fprintf(&buf, "new mode %04o\n", pm.Mode)
+	return buf.Bytes(), nil
+}
+
+// applyDir creates the destination directory of pm, or changes its permission if it is set by the modes config,
+// and records it in the store. The permission is not changed if it has been modified since the last apply,
+// unless overwrite is true.
+func (a *App) applyDir(pm PathMapping, overwrite bool) error {
+	de, err := entryCache.Get(pm.Destination)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case de.Empty || !de.Mode.IsDir():
+		if err := system.MkdirAll(pm.Destination, pm.Mode); err != nil {
+			return err
+		}
+		// the permission of a created directory is affected by umask
+		if err := system.Chmod(pm.Destination, pm.Mode); err != nil {
+			return err
+		}
+	case pm.ModeSet && de.Mode.Perm() != pm.Mode:
+		if modified, err := a.dirModified(de); err != nil {
+			return err
+		} else if modified && !overwrite {
+			fmt.Fprintf(a.out, "Skipped: %s has been modified since the last apply. use --overwrite to overwrite\n", pm.Destination)
+			return nil
+		}
+		if err := system.Chmod(pm.Destination, pm.Mode); err != nil {
+			return err
+		}
+	}
+
+	if err := a.record(pm.Destination); err != nil {
+		return err
+	}
+	de, err = entryCache.Get(pm.Destination)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Applied: %s with mode %04o\n", pm.Destination, de.Mode.Perm())
+	return nil
+}
+
+// dirModified reports whether the permission of the directory de has been changed since the last apply.
+func (a *App) dirModified(de *Entry) (bool, error) {
+	var be *Entry
+	if err := a.store.Get(store.EntryBucket, de.Path, &be); err != nil || be == nil {
+		return false, err
+	}
+	return be.Mode.IsDir() && be.Mode.Perm() != de.Mode.Perm(), nil
+}
@@ -6,31 +6,59 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
+	"slices"
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/nishikirb/donut/config"
+	"github.com/nishikirb/donut/diff"
+	"github.com/nishikirb/donut/logger"
 	"github.com/nishikirb/donut/store"
 	"github.com/nishikirb/donut/system"
 )
 
+// ErrDiffFound is returned when differences between source and destination files exist
+// and the caller asked for it to be reported as a failure.
+var ErrDiffFound = errors.New("differences found")
+
 type App struct {
 	commands map[string]handler
 	opts     []Option
 	config   *config.Config
-	in       io.Reader
-	out      io.Writer
-	err      io.Writer
+	store    store.Store
+	// stateFile and storeOpts are used to open the store when it is not given
+	stateFile string
+	storeOpts []store.Option
+	// wait is true if the store is opened after the lock held by another process is released
+	wait bool
+	// rehash is true if the sums cached in the store are not used
+	rehash bool
+	// batch collects the writes to the store while applying, see batched
+	batch *store.Batch
+	in    io.Reader
+	out   io.Writer
+	err   io.Writer
 }
 
 type handler func(ctx context.Context, args []string, flags *pflag.FlagSet) error
 
+// statelessCommands do not use the store, so that they never wait for the lock held by another process.
+// watch opens the store only while it handles each batch of changes.
+var statelessCommands = []string{"init", "list", "diff", "check", "where", "config", "watch"}
+
+// sumCachingCommands reuse the sums cached in the store. The stateless ones read and write
+// the cached sums apart from the run, only when the store is not locked by another process.
+var sumCachingCommands = []string{"diff", "check", "apply", "merge", "watch"}
+
+// readOnlyCommands open the store for reading only, sharing it with the other readers.
+var readOnlyCommands = []string{"state dump", "state get", "state export"}
+
 func NewApp(opts ...Option) *App {
 	cfg, _ := config.New(config.WithDefault())
 	app := &App{
@@ -44,11 +72,23 @@ func NewApp(opts ...Option) *App {
 	app.handle("init", app.init)
 	app.handle("list", app.list)
 	app.handle("diff", app.diff)
+	app.handle("check", app.check)
 	app.handle("merge", app.merge)
 	app.handle("where", app.where)
 	app.handle("config", app.editConfig)
 	app.handle("apply", app.apply)
 	app.handle("clean", app.clean)
+	app.handle("gc", app.gc)
+	app.handle("restore", app.restore)
+	app.handle("watch", app.watch)
+	app.handle("state migrate", app.migrateState)
+	app.handle("state dump", app.dumpState)
+	app.handle("state get", app.getState)
+	app.handle("state set", app.setState)
+	app.handle("state delete", app.deleteState)
+	app.handle("state forget", app.forgetState)
+	app.handle("state export", app.exportState)
+	app.handle("state import", app.importState)
 
 	return app
 }
@@ -67,7 +107,7 @@ func (a *App) ApplyOptions() error {
 	return nil
 }
 
-func (a *App) Run(ctx context.Context, command string, args []string, flags *pflag.FlagSet) error {
+func (a *App) Run(ctx context.Context, command string, args []string, flags *pflag.FlagSet) (err error) {
 	h, ok := a.commands[command]
 	if !ok {
 		return fmt.Errorf("unknown command: %s", command)
@@ -76,17 +116,59 @@ func (a *App) Run(ctx context.Context, command string, args []string, flags *pfl
 	if err := a.ApplyOptions(); err != nil {
 		return err
 	}
+	// the concurrent workers of the run write to the same output
+	a.out, a.err = newLockedWriter(a.out), newLockedWriter(a.err)
+	if a.store == nil && !slices.Contains(statelessCommands, command) {
+		opts := a.storeOpts
+		if slices.Contains(readOnlyCommands, command) {
+			opts = append(slices.Clip(opts), store.WithReadOnly())
+		}
+		if err := a.openStore(ctx, opts...); err != nil {
+			return err
+		}
+		defer func() { err = errors.Join(err, a.closeStore()) }()
+	}
+	if slices.Contains(sumCachingCommands, command) {
+		sums, serr := a.sumCache()
+		if serr != nil {
+			logger.Info().Str("state", a.statePath()).Err(serr).Msg("Skip sum cache")
+		}
+		if sums != nil {
+			entryCache.SetSums(sums)
+			defer func() {
+				entryCache.SetSums(nil)
+				err = errors.Join(err, sums.flush())
+			}()
+		}
+	}
 
-	if err := createTemplateMap(map[string][]string{
-		"diff":  a.config.Diff[1:],
-		"merge": a.config.Merge[1:],
-	}); err != nil {
-		return err
+	// init runs without a config, as it creates one
+	if a.config != nil {
+		entryCache.SetHash(a.config.Hash)
+		if err := a.createTemplates(); err != nil {
+			return err
+		}
 	}
 
 	return h(ctx, args, flags)
 }
 
+func (a *App) createTemplates() error {
+	tmap := map[string][]string{
+		"merge": a.config.Merge[1:],
+	}
+	if len(a.config.MergeBatch) > 0 {
+		tmap["merge_batch"] = a.config.MergeBatch[1:]
+	}
+	if len(a.config.OnDrift) > 0 {
+		tmap["on_drift"] = a.config.OnDrift[1:]
+	}
+	if !isBuiltinDiff(a.config.Diff) {
+		tmap["diff"] = a.config.Diff[1:]
+	}
+	return createTemplateMap(tmap)
+}
+
 func (a *App) init(_ context.Context, _ []string, _ *pflag.FlagSet) error {
 	// check config file exists in default path
 	// if exists, no need to init
@@ -112,7 +194,7 @@ func (a *App) init(_ context.Context, _ []string, _ *pflag.FlagSet) error {
 }
 
 func (a *App) list(_ context.Context, _ []string, _ *pflag.FlagSet) error {
-	mapper, err := NewPathMapper(a.config.Source, a.config.Destination, WithExcludes(a.config.Excludes...))
+	mapper, err := a.pathMapper()
 	if err != nil {
 		return err
 	}
@@ -120,106 +202,225 @@ func (a *App) list(_ context.Context, _ []string, _ *pflag.FlagSet) error {
 	for _, relSourcePath := range mapper.RelSourcePaths() {
 		fmt.Fprintln(a.out, relSourcePath)
 	}
+	// the removals are listed while they still exist
+	for _, pm := range mapper.Mapping {
+		if !pm.Remove {
+			continue
+		}
+		if ok, err := removeChanged(pm); err != nil {
+			return err
+		} else if ok {
+			fmt.Fprintf(a.out, "%s (remove)\n", pm.Destination)
+		}
+	}
 	return nil
 }
 
-func (a *App) diff(ctx context.Context, _ []string, _ *pflag.FlagSet) error {
-	mapper, err := NewPathMapper(a.config.Source, a.config.Destination, WithExcludes(a.config.Excludes...))
-	if err != nil {
-		return err
+func (a *App) diff(ctx context.Context, _ []string, flags *pflag.FlagSet) (err error) {
+	noPager, _ := flags.GetBool("no-pager")
+	exitCode, _ := flags.GetBool("exit-code")
+	sinceApply, _ := flags.GetBool("since-apply")
+
+	var diffs [][]byte
+	var found bool
+	if sinceApply {
+		// only this diff reads the store, so it is not opened for the others
+		if a.store == nil {
+			if err := a.openStore(ctx, append(slices.Clip(a.storeOpts), store.WithReadOnly())...); err != nil {
+				return err
+			}
+			defer func() { err = errors.Join(err, a.closeStore()) }()
+		}
+		dsts, err := a.store.Keys(store.EntryBucket)
+		if err != nil {
+			return err
+		}
+		if diffs, err = diffEach(ctx, a.config.Concurrency, dsts, func(_ context.Context, dst string) ([]byte, error) {
+			return a.diffSinceApply(dst)
+		}); err != nil {
+			return err
+		}
+		found = slices.ContainsFunc(diffs, func(d []byte) bool { return len(d) > 0 })
+	} else {
+		mapper, err := a.pathMapper()
+		if err != nil {
+			return err
+		}
+		changes, err := a.changes(ctx, mapper.Mapping)
+		if err != nil {
+			return err
+		}
+		if diffs, err = diffEach(ctx, a.config.Concurrency, changes, a.diffFile); err != nil {
+			return err
+		}
+		found = len(changes) > 0
 	}
+	out := bytes.Join(diffs, nil)
 
-	diffCmdName := a.config.Diff[0]
-	diffCh := make(chan []byte, len(mapper.Mapping))
-	eg, ectx := errgroup.WithContext(context.Background())
-	eg.SetLimit(a.config.Concurrency)
-	for _, pm := range mapper.Mapping {
-		pm := pm
+	// the pager is skipped when the output is not a terminal, e.g. in CI
+	if noPager || !system.IsTerminal(a.out) {
+		if _, err := a.out.Write(out); err != nil {
+			return err
+		}
+	} else {
+		pagerCmdName, pagerCmdArgs := a.config.Pager[0], a.config.Pager[1:]
+		cmd := exec.CommandContext(ctx, pagerCmdName, pagerCmdArgs...)
+		cmd.Stdin = bytes.NewBuffer(out)
+		cmd.Stdout = unwrap(a.out)
+		if err := system.Run(cmd); err != nil {
+			return err
+		}
+	}
+
+	if exitCode && found {
+		return ErrDiffFound
+	}
+	return nil
+}
+
+// diffEach returns the differences of the targets rendered by fn concurrently, in the order of the targets.
+func diffEach[T any](ctx context.Context, concurrency int, targets []T, fn func(context.Context, T) ([]byte, error)) ([][]byte, error) {
+	// each worker writes into its own slot so that the output keeps the order
+	diffs := make([][]byte, len(targets))
+	eg, ectx := errgroup.WithContext(ctx)
+	eg.SetLimit(concurrency)
+	for i, t := range targets {
+		i, t := i, t
 		eg.Go(func() error {
 			select {
 			case <-ectx.Done():
 				return ectx.Err()
 			default:
-				ss, err := entryCache.GetSum(pm.Source)
+				out, err := fn(ectx, t)
 				if err != nil {
 					return err
 				}
-				ds, err := entryCache.GetSum(pm.Destination)
-				if err != nil {
-					return err
-				}
-				if bytes.Equal(ss, ds) {
-					return nil
-				}
-
-				argsBuilder := strings.Builder{}
-				data := templateParams(pm)
-				if err := tmpl.ExecuteTemplate(&argsBuilder, "diff", data); err != nil {
-					return err
-				}
-				args := strings.Split(argsBuilder.String(), " ")
-				cmd := exec.CommandContext(ectx, diffCmdName, args...)
-				out, _ := system.Output(cmd)
-				diffCh <- out
+				diffs[i] = out
 				return nil
 			}
 		})
 	}
-
 	if err := eg.Wait(); err != nil {
-		return err
+		return nil, err
 	}
-	close(diffCh)
-	var diff []byte
-	for v := range diffCh {
-		diff = append(diff, v...)
+	return diffs, nil
+}
+
+func (a *App) check(ctx context.Context, _ []string, _ *pflag.FlagSet) error {
+	mapper, err := a.pathMapper()
+	if err != nil {
+		return err
 	}
 
-	pagerCmdName, pagerCmdArgs := a.config.Pager[0], a.config.Pager[1:]
-	cmd := exec.CommandContext(ctx, pagerCmdName, pagerCmdArgs...)
-	cmd.Stdin = bytes.NewBuffer(diff)
-	cmd.Stdout = a.out
-	if err := system.Run(cmd); err != nil {
+	changes, err := a.changes(ctx, mapper.Mapping)
+	if err != nil {
 		return err
 	}
+	for _, pm := range changes {
+		fmt.Fprintln(a.out, pm.Destination)
+	}
+
+	if len(changes) > 0 {
+		return ErrDiffFound
+	}
 	return nil
 }
 
-func (a *App) merge(ctx context.Context, _ []string, _ *pflag.FlagSet) error {
-	mapper, err := NewPathMapper(a.config.Source, a.config.Destination, WithExcludes(a.config.Excludes...))
+// diffFile returns the differences between the destination and the source of pm.
+// The built-in renderer is used when the diff command is empty or set to "builtin".
+func (a *App) diffFile(ctx context.Context, pm PathMapping) ([]byte, error) {
+	if pm.Dir {
+		return dirDiff(pm)
+	}
+	// an external diff command would compare the whole destination file with the view,
+	// and has nothing to compare a removal with
+	if isBuiltinDiff(a.config.Diff) || pm.View != nil || pm.Remove {
+		return a.builtinDiff(pm, a.config.DiffContext)
+	}
+
+	args, err := executeTemplate("diff", newTemplateParams(pm))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	cmd := exec.CommandContext(ctx, a.config.Diff[0], args...)
+	// diff exits with status 1 when the files differ, so the error is ignored
+	out, _ := system.Output(cmd)
+	return out, nil
+}
 
-	mergeCmdName := a.config.Merge[0]
-	for _, pm := range mapper.Mapping {
-		ss, err := entryCache.GetSum(pm.Source)
-		if err != nil {
-			return err
-		}
-		ds, err := entryCache.GetSum(pm.Destination)
-		if err != nil {
-			return err
-		}
-		if bytes.Equal(ss, ds) {
-			continue
+// builtinDiff renders the differences of pm with the built-in renderer.
+func (a *App) builtinDiff(pm PathMapping, context int) ([]byte, error) {
+	if pm.Remove {
+		return a.removeDiff(pm, context)
+	}
+	de, err := entryCache.Get(pm.Destination)
+	if err != nil {
+		return nil, err
+	}
+	se, err := entryCache.Get(pm.Source)
+	if err != nil {
+		return nil, err
+	}
+	// the contents are not needed after the diff is rendered
+	defer de.release()
+	defer se.release()
+	dc, err := de.GetView()
+	if err != nil {
+		return nil, err
+	}
+	sc, err := se.GetContent()
+	if err != nil {
+		return nil, err
+	}
+	if pm.View != nil {
+		if sc, err = pm.View.Normalize(sc); err != nil {
+			return nil, err
 		}
+	}
 
-		argsBuilder := strings.Builder{}
-		data := templateParams(pm)
-		if err := tmpl.ExecuteTemplate(&argsBuilder, "merge", data); err != nil {
-			return err
-		}
-		args := strings.Split(argsBuilder.String(), " ")
-		cmd := exec.CommandContext(ctx, mergeCmdName, args...)
-		cmd.Stdin = a.in
-		cmd.Stdout = a.out
-		if err := system.Run(cmd); err != nil {
-			return err
+	var buf bytes.Buffer
+	if err := diff.Unified(&buf,
+		diff.File{Name: pm.Destination, Content: dc},
+		diff.File{Name: pm.Source, Content: sc},
+		diff.WithContext(context),
+		diff.WithColor(a.config.Color && system.IsTerminal(a.out)),
+	); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (a *App) merge(ctx context.Context, _ []string, flags *pflag.FlagSet) error {
+	batch, _ := flags.GetBool("batch")
+	continueOnError, _ := flags.GetBool("continue-on-error")
+
+	mapper, err := a.pathMapper()
+	if err != nil {
+		return err
+	}
+
+	changes, err := a.changes(ctx, mapper.Mapping)
+	if err != nil {
+		return err
+	}
+	// directories and removals have nothing to merge, and the merge tool does not know about views
+	changes = slices.DeleteFunc(changes, func(pm PathMapping) bool { return pm.Dir || pm.View != nil || pm.Remove })
+	if batch {
+		return a.mergeBatch(ctx, changes)
+	}
+
+	var errs []error
+	for _, pm := range changes {
+		if err := a.mergeFile(ctx, pm); err != nil {
+			if !continueOnError {
+				return err
+			}
+			fmt.Fprintf(a.err, "Failed: %s: %v\n", pm.Destination, err)
+			errs = append(errs, err)
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 func (a *App) where(_ context.Context, args []string, _ *pflag.FlagSet) error {
@@ -233,6 +434,8 @@ func (a *App) where(_ context.Context, args []string, _ *pflag.FlagSet) error {
 		fmt.Fprintln(a.out, a.config.Destination)
 	case "config":
 		fmt.Fprintln(a.out, filepath.Dir(a.config.File))
+	case "state":
+		fmt.Fprintln(a.out, a.statePath())
 	default:
 	}
 	return nil
@@ -244,94 +447,266 @@ func (a *App) editConfig(ctx context.Context, _ []string, _ *pflag.FlagSet) erro
 	args := append(editorCmdArgs, a.config.File)
 	cmd := exec.CommandContext(ctx, editorCmdName, args...)
 	cmd.Stdin = a.in
-	cmd.Stdout = a.out
+	cmd.Stdout = unwrap(a.out)
 	return system.Run(cmd)
 }
 
 func (a *App) apply(ctx context.Context, _ []string, flags *pflag.FlagSet) error {
 	overwrite, _ := flags.GetBool("overwrite")
+	interactive, _ := flags.GetBool("interactive")
+
+	mapper, err := a.pathMapper()
+	if err != nil {
+		return err
+	}
+
+	changes, err := a.changes(ctx, mapper.Mapping)
+	if err != nil {
+		return err
+	}
+	return a.batched(func() error {
+		return a.applyChanges(ctx, mapper, changes, overwrite, interactive)
+	})
+}
+
+// applyChanges applies the changes, the externals and the removals of the unmanaged files.
+func (a *App) applyChanges(ctx context.Context, mapper *PathMapper, changes []PathMapping, overwrite, interactive bool) error {
+	if interactive {
+		if err := a.applyInteractive(ctx, changes, overwrite); errors.Is(err, errQuit) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	} else if err := a.applyAll(ctx, changes, overwrite); err != nil {
+		return err
+	}
+	if err := a.rehashUnchanged(mapper.Mapping, changes); err != nil {
+		return err
+	}
+	if err := a.applyExternals(ctx, overwrite, interactive); err != nil {
+		return err
+	}
+	return a.removeUnmanaged(mapper, interactive)
+}
+
+// rehashUnchanged records again the unchanged destinations whose sums were recorded with another algorithm
+// than the hash setting, so that a changed setting takes effect without the destinations being applied again.
+func (a *App) rehashUnchanged(mappings, changes []PathMapping) error {
+	changed := make(map[string]bool, len(changes))
+	for _, pm := range changes {
+		changed[pm.Destination] = true
+	}
+	for _, pm := range mappings {
+		if pm.Dir || pm.Remove || changed[pm.Destination] {
+			continue
+		}
+		var be *Entry
+		if err := a.store.Get(store.EntryBucket, pm.Destination, &be); err != nil {
+			return err
+		} else if be == nil {
+			continue
+		}
+		de, err := entryCache.Get(pm.Destination)
+		if err != nil {
+			return err
+		}
+		if de.Empty || be.algorithm() == de.algorithm() {
+			continue
+		}
+		if modified, err := a.modified(pm.Destination); err != nil {
+			return err
+		} else if modified {
+			continue
+		}
+		if err := a.record(pm.Destination); err != nil {
+			return fmt.Errorf("recording %s: %w", pm.Destination, err)
+		}
+		logger.Info().Str("path", pm.Destination).Str("hash", de.algorithm()).Msg("Rehash")
+	}
+	return nil
+}
 
-	mapper, err := NewPathMapper(a.config.Source, a.config.Destination, WithExcludes(a.config.Excludes...))
+// removeUnmanaged removes the unmanaged children of the exact directories.
+func (a *App) removeUnmanaged(mapper *PathMapper, interactive bool) error {
+	paths, err := mapper.Unmanaged()
 	if err != nil {
 		return err
 	}
+	// the externals are managed as well
+	var externals []string
+	for _, e := range a.config.Externals {
+		externals = append(externals, a.externalDestination(e))
+	}
+	for _, path := range paths {
+		if affected(path, externals) {
+			continue
+		}
+		if interactive {
+			if ok, err := a.confirm("Remove %s?", path); err != nil {
+				return err
+			} else if !ok {
+				fmt.Fprintf(a.out, "Skipped: %s\n", path)
+				continue
+			}
+		}
+		if err := a.remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyAll applies the mappings. Directories are applied first in order, so that the files
+// are never created in a directory with a looser permission, then the files concurrently.
+func (a *App) applyAll(ctx context.Context, mappings []PathMapping, overwrite bool) error {
+	var files []PathMapping
+	for _, pm := range mappings {
+		if !pm.Dir {
+			files = append(files, pm)
+		} else if err := a.applyDir(pm, overwrite); err != nil {
+			return err
+		}
+	}
 
 	eg, ectx := errgroup.WithContext(ctx)
 	eg.SetLimit(a.config.Concurrency)
-	for _, pm := range mapper.Mapping {
+	for _, pm := range files {
 		pm := pm
 		eg.Go(func() error {
 			select {
 			case <-ectx.Done():
 				return ectx.Err()
 			default:
-				ss, err := entryCache.GetSum(pm.Source)
-				if err != nil {
-					return err
-				}
-				ds, err := entryCache.GetSum(pm.Destination)
-				if err != nil {
-					return err
-				}
-				if bytes.Equal(ss, ds) {
-					return nil
-				}
+				return a.applyFile(pm, overwrite)
+			}
+		})
+	}
 
-				var be *Entry
-				if err := store.Get(store.EntryBucket, pm.Destination, &be); err != nil {
-					return err
-				}
-				bs, err := be.GetSum()
-				if err != nil {
-					return err
-				}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	return nil
+}
 
-				// skip if the following conditions are met
-				// 1. exists in store
-				// 2. checksum is equal to destination
-				// 3. overwrite is false
-				if bs != nil && !bytes.Equal(bs, ds) && !overwrite {
-					fmt.Fprintf(a.out, "Skipped: %s has been modified since the last apply. use --overwrite to overwrite\n", pm.Destination)
-					return nil
-				}
+// applyFile overwrites the destination of pm with the source and records it in the store.
+// The destination is skipped if it has been modified since the last apply, unless overwrite is true.
+func (a *App) applyFile(pm PathMapping, overwrite bool) error {
+	if pm.Dir {
+		return a.applyDir(pm, overwrite)
+	}
+	// the removal is declared explicitly, so it is not skipped even if the destination was modified
+	if pm.Remove {
+		return a.removeDeclared(pm)
+	}
+	if modified, err := a.modified(pm.Destination); err != nil {
+		return err
+	} else if modified && !overwrite {
+		fmt.Fprintf(a.out, "Skipped: %s has been modified since the last apply. use --overwrite to overwrite\n", pm.Destination)
+		return nil
+	}
+
+	// If the directory does not exists, create it
+	// os.MkdirAll will return nil if directory already exists
+	dir := filepath.Dir(pm.Destination)
+	if err := system.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	de, err := a.overwrite(pm.Source, pm.Destination)
+	if err != nil {
+		return err
+	}
+
+	if err := a.recordEntry(de); err != nil {
+		return fmt.Errorf("recording %s: %w", pm.Destination, err)
+	}
+	fmt.Fprintf(a.out, "Applied: %s from %s\n", pm.Destination, pm.Source)
+	return nil
+}
+
+// modified reports whether dst has been modified since the last apply.
+func (a *App) modified(dst string) (bool, error) {
+	var be *Entry
+	if err := a.store.Get(store.EntryBucket, dst, &be); err != nil {
+		return false, err
+	}
+	bs, err := be.GetSum()
+	if err != nil || bs == nil {
+		return false, err
+	}
+
+	// the destination is hashed with the algorithm of the recorded sum,
+	// so that changing the hash setting is not taken as a modification
+	de, err := entryCache.Get(dst)
+	if err != nil {
+		return false, err
+	}
+	ds, err := de.sumWith(be.algorithm())
+	if err != nil {
+		return false, err
+	}
+
+	// modified if the following conditions are met
+	// 1. exists in store
+	// 2. checksum is not equal to destination
+	return !bytes.Equal(bs, ds), nil
+}
 
-				// If the directory does not exists, create it
-				// os.MkdirAll will return nil if directory already exists
-				dir := filepath.Dir(pm.Destination)
-				if err := system.MkdirAll(dir, os.ModePerm); err != nil {
+func (a *App) clean(ctx context.Context, _ []string, flags *pflag.FlagSet) error {
+	return a.store.Clear()
+}
+
+// changes returns the mappings whose source and destination differ, in the order of mappings.
+func (a *App) changes(ctx context.Context, mappings []PathMapping) ([]PathMapping, error) {
+	changed := make([]bool, len(mappings))
+	eg, ectx := errgroup.WithContext(ctx)
+	eg.SetLimit(a.config.Concurrency)
+	for i, pm := range mappings {
+		i, pm := i, pm
+		eg.Go(func() error {
+			select {
+			case <-ectx.Done():
+				return ectx.Err()
+			default:
+				if pm.Dir {
+					c, err := dirChanged(pm)
+					changed[i] = c
 					return err
 				}
-				if err := a.overwrite(pm.Source, pm.Destination); err != nil {
+				if pm.Remove {
+					c, err := removeChanged(pm)
+					changed[i] = c
 					return err
 				}
-
-				de, err := entryCache.Reload(pm.Destination)
+				ss, err := sourceSum(pm)
 				if err != nil {
 					return err
 				}
-				if err := store.Set(store.EntryBucket, pm.Destination, de); err != nil {
+				ds, err := entryCache.GetSum(pm.Destination)
+				if err != nil {
 					return err
 				}
-				fmt.Fprintf(a.out, "Applied: %s from %s\n", pm.Destination, pm.Source)
+				changed[i] = !bytes.Equal(ss, ds)
 				return nil
 			}
 		})
 	}
 
 	if err := eg.Wait(); err != nil {
-		return err
+		return nil, err
 	}
-	return nil
-}
 
-func (a *App) clean(ctx context.Context, _ []string, flags *pflag.FlagSet) error {
-	if err := store.Close(); err != nil {
-		return err
-	}
-	if err := system.Remove(store.DefaultDBFile()); err != nil {
-		return err
+	var result []PathMapping
+	for i, pm := range mappings {
+		if changed[i] {
+			result = append(result, pm)
+		}
 	}
-	return nil
+	return result, nil
+}
+
+// isBuiltinDiff reports whether the diff command selects the built-in renderer.
+func isBuiltinDiff(cmd []string) bool {
+	return len(cmd) == 0 || cmd[0] == diff.Builtin
 }
 
 func (a *App) handle(name string, h handler) {
@@ -341,18 +716,197 @@ func (a *App) handle(name string, h handler) {
 	a.commands[name] = h
 }
 
-// overwrite replaces the contents of dst with the contents of src.
-func (a *App) overwrite(src, dst string) error {
-	se, err := entryCache.Get(src)
+// pathMapper maps the source directory to the destination directory with the config.
+// The destinations managed by views are registered to the entry cache.
+func (a *App) pathMapper() (*PathMapper, error) {
+	blocks := make(map[string]*Block, len(a.config.Blocks))
+	for _, b := range a.config.Blocks {
+		comment := b.Comment
+		if comment == "" {
+			comment = "#"
+		}
+		blocks[b.Path] = NewBlock(comment, b.Position == config.BlockPositionPrepend)
+	}
+	modes := make(map[string]fs.FileMode, len(a.config.Modes))
+	for _, m := range a.config.Modes {
+		modes[m.Path] = m.Mode
+	}
+	patches := make(map[string]string, len(a.config.Patches))
+	for _, p := range a.config.Patches {
+		patches[p.Path] = p.Format
+	}
+
+	mapper, err := NewPathMapper(a.config.Source, a.config.Destination,
+		WithExcludes(a.config.Excludes...),
+		WithModes(modes),
+		WithExact(a.config.Exact...),
+		WithBlocks(blocks),
+		WithPatches(patches),
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, pm := range mapper.Mapping {
+		if pm.View != nil {
+			entryCache.SetView(pm.Destination, pm.View)
+		}
+	}
+	return mapper, nil
+}
+
+// record saves the current state of dst in the store as the last applied state.
+func (a *App) record(dst string) error {
+	de, err := entryCache.Reload(dst)
 	if err != nil {
 		return err
 	}
+	return a.recordEntry(de)
+}
+
+// recordEntry saves de, the current state of its destination, in the store as the last applied state.
+func (a *App) recordEntry(de *Entry) error {
+	dst := de.Path
+	var err error
+	if !de.Empty && !de.Mode.IsDir() {
+		if de.Blob, err = a.blobs().Put(dst); err != nil {
+			return err
+		}
+	}
+	return a.storeSet(store.EntryBucket, dst, de)
+}
+
+// batched runs fn, collecting its writes to the store in a batch that is written in a single
+// transaction at the end. The writes made before fn failed are written as well, as the files
+// they record have been applied.
+func (a *App) batched(fn func() error) error {
+	a.batch = store.NewBatch()
+	defer func() { a.batch = nil }()
+
+	err := fn()
+	if werr := a.store.Write(a.batch); werr != nil {
+		err = errors.Join(err, fmt.Errorf("recording %d changes: %w", a.batch.Len(), werr))
+	}
+	return err
+}
+
+// storeSet sets the value of the key, in the batch if any.
+func (a *App) storeSet(bucket, key string, value any) error {
+	if a.batch != nil {
+		return a.batch.Set(bucket, key, value)
+	}
+	return a.store.Set(bucket, key, value)
+}
+
+// storeDelete deletes the key, in the batch if any. The cached sum of an entry is deleted with it,
+// so that the sums of the paths no longer managed do not pile up.
+func (a *App) storeDelete(bucket, key string) error {
+	if a.batch != nil {
+		a.batch.Delete(bucket, key)
+		if bucket == store.EntryBucket {
+			a.batch.Delete(store.SumBucket, key)
+		}
+		return nil
+	}
+	if bucket == store.EntryBucket {
+		if err := a.store.Delete(store.SumBucket, key); err != nil {
+			return err
+		}
+	}
+	return a.store.Delete(bucket, key)
+}
+
+// overwrite replaces the contents of dst with the contents of src, and returns the entry of dst.
+// If dst is managed by a view, only the view is replaced, keeping the permission of dst.
+func (a *App) overwrite(src, dst string) (*Entry, error) {
+	de, err := entryCache.Get(dst)
+	if err != nil {
+		return nil, err
+	}
+	if de.view == nil {
+		return copyFile(src, dst, os.ModePerm)
+	}
+
+	se, err := entryCache.Get(src)
+	if err != nil {
+		return nil, err
+	}
 	sc, err := se.GetContent()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if err := system.Overwrite(dst, sc, os.ModePerm); err != nil {
-		return err
+	dc, err := de.GetContent()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	perm := os.ModePerm
+	if !de.Empty {
+		perm = de.Mode.Perm()
+	}
+	content, err := de.view.Replace(dc, sc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dst, err)
+	}
+	se.release()
+	if err := system.Overwrite(dst, content, perm); err != nil {
+		return nil, err
+	}
+	return entryCache.Reload(dst)
+}
+
+// copyFile streams src to dst, hashing it on the way, so that large files are never held in memory.
+// A new dst is created with perm, and dst is left untouched if the content of src differs from the sum computed before.
+func copyFile(src, dst string, perm fs.FileMode) (*Entry, error) {
+	se, err := entryCache.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	want, err := se.GetSum()
+	if err != nil {
+		return nil, err
+	}
+	f, err := system.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := newHash(se.algorithm())
+	if err != nil {
+		return nil, err
+	}
+	check := func() error {
+		if !bytes.Equal(h.Sum(nil), want) {
+			return fmt.Errorf("%s has been changed while applying", src)
+		}
+		return nil
+	}
+	if err := system.OverwriteFrom(dst, io.TeeReader(f, h), perm, check); err != nil {
+		return nil, err
+	}
+	de, err := entryCache.Reload(dst)
+	if err != nil {
+		return nil, err
+	}
+	// the written content is known, so it is not read again to record it
+	de.sum = want
+	return de, nil
+}
+
+// sourceSum returns the checksum of the source of pm, in the same form as the destination one.
+func sourceSum(pm PathMapping) ([]byte, error) {
+	if pm.View == nil {
+		return entryCache.GetSum(pm.Source)
+	}
+	sc, err := readEntry(pm.Source)
+	if err != nil {
+		return nil, err
+	}
+	if sc, err = pm.View.Normalize(sc); err != nil {
+		return nil, err
+	}
+	de, err := entryCache.Get(pm.Destination)
+	if err != nil {
+		return nil, err
+	}
+	return sumOf(de.algorithm(), sc)
 }
@@ -2,14 +2,106 @@ package donut
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/spf13/pflag"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/nishikirb/donut/config"
+	"github.com/nishikirb/donut/store"
 	"github.com/nishikirb/donut/test/helper"
+	"github.com/nishikirb/donut/xxhash"
 )
 
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "donut-test-")
+	if err != nil {
+		panic(err)
+	}
+	// the state files are created in the state directory under the home directory
+	restore := config.SetUserHomeDir(dir)
+	code := m.Run()
+	restore()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testApp is the fixture of the App tests: a config managing a temporary source directory
+// into a temporary destination directory, and the options of its runs.
+type testApp struct {
+	src, dst string
+	cfg      *config.Config
+	opts     []Option
+	// stderr is what the last run wrote to the error output
+	stderr *bytes.Buffer
+}
+
+func newTestApp(t *testing.T, opts ...Option) *testApp {
+	src, dst := t.TempDir(), t.TempDir()
+	return &testApp{
+		src: src,
+		dst: dst,
+		cfg: &config.Config{
+			Source:      src,
+			Destination: dst,
+			Merge:       []string{"vimdiff"},
+			Concurrency: 2,
+		},
+		opts:   opts,
+		stderr: &bytes.Buffer{},
+	}
+}
+
+// with returns the fixture whose runs have the options added.
+func (ta *testApp) with(opts ...Option) *testApp {
+	c := *ta
+	c.opts = append(slices.Clip(ta.opts), opts...)
+	return &c
+}
+
+// app returns a new App of the fixture. The entry cache is reset, as each command runs in a new process.
+func (ta *testApp) app(opts ...Option) *App {
+	entryCache = &EntryCache{}
+	ta.stderr.Reset()
+	base := []Option{WithConfig(ta.cfg), WithOut(&bytes.Buffer{}), WithErr(ta.stderr)}
+	return NewApp(append(append(base, ta.opts...), opts...)...)
+}
+
+// run runs the command in a new App, and returns what it wrote to the output.
+// The arguments starting with "--" are boolean flags set to true.
+func (ta *testApp) run(command string, args ...string) (string, error) {
+	return ta.runContext(context.Background(), command, args...)
+}
+
+func (ta *testApp) runContext(ctx context.Context, command string, args ...string) (string, error) {
+	flags := pflag.NewFlagSet(command, pflag.ContinueOnError)
+	var rest []string
+	for _, arg := range args {
+		if name, ok := strings.CutPrefix(arg, "--"); ok {
+			flags.Bool(name, true, "")
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	stdout := &bytes.Buffer{}
+	err := ta.app(WithOut(stdout)).Run(ctx, command, rest, flags)
+	return stdout.String(), err
+}
+
 func TestNewApp(t *testing.T) {
 	home, _, _, _ := helper.CreateBaseDir(t)
 	helper.SetDirEnv(t, home)
@@ -92,3 +184,1096 @@ func TestNewApp(t *testing.T) {
 		})
 	}
 }
+
+func TestApp_Diff(t *testing.T) {
+	ta := newTestApp(t)
+	ta.cfg.Pager = []string{"cat"}
+	ta.cfg.Diff = []string{"builtin"}
+	ta.cfg.DiffContext = 3
+	ta.cfg.Concurrency = 8
+	var want string
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		helper.WriteFile(t, filepath.Join(ta.src, name), []byte(name+"\n"), 0644)
+		want += fmt.Sprintf("--- %s\n+++ %s\n@@ -0,0 +1 @@\n+%s\n", filepath.Join(ta.dst, name), filepath.Join(ta.src, name), name)
+	}
+
+	// run several times to make sure the order does not depend on goroutine scheduling
+	for i := 0; i < 5; i++ {
+		out, err := ta.run("diff")
+		assert.NoError(t, err)
+		assert.Equal(t, want, out)
+	}
+}
+
+func TestApp_Check(t *testing.T) {
+	ta := newTestApp(t)
+	helper.WriteFile(t, filepath.Join(ta.src, "same"), []byte("same\n"), 0644)
+	helper.WriteFile(t, filepath.Join(ta.dst, "same"), []byte("same\n"), 0644)
+	helper.WriteFile(t, filepath.Join(ta.src, "changed"), []byte("new\n"), 0644)
+	helper.WriteFile(t, filepath.Join(ta.dst, "changed"), []byte("old\n"), 0644)
+	helper.WriteFile(t, filepath.Join(ta.src, "missing"), []byte("new\n"), 0644)
+
+	out, err := ta.run("check")
+	assert.ErrorIs(t, err, ErrDiffFound)
+	assert.Equal(t, filepath.Join(ta.dst, "changed")+"\n"+filepath.Join(ta.dst, "missing")+"\n", out)
+}
+
+func TestApp_Merge(t *testing.T) {
+	tests := []struct {
+		name      string
+		merge     []string
+		batch     []string
+		flags     []string
+		in        string
+		wantDst   map[string]string
+		wantSrc   map[string]string
+		wantOut   string
+		assertion assert.ErrorAssertionFunc
+	}{
+		{
+			name: "OK/WriteBack",
+			// the merge tool overwrites the destination with a merged content
+			merge:     []string{"sh", "-c", `echo merged > "$1"`, "sh", "{{.Destination}}"},
+			in:        "y\nn\n",
+			wantDst:   map[string]string{"changed": "merged\n", "dir/missing": "merged\n"},
+			wantSrc:   map[string]string{"changed": "merged\n", "dir/missing": "new\n"},
+			wantOut:   "Write the merged {dst}/changed back to {src}/changed? [y/N] Updated: {src}/changed\nWrite the merged {dst}/dir/missing back to {src}/dir/missing? [y/N] ",
+			assertion: assert.NoError,
+		},
+		{
+			name:  "OK/Batch",
+			merge: []string{"false"},
+			// copy the whole temporary source tree into the temporary destination tree
+			batch:     []string{"sh", "-c", `cp -R "$1"/. "$2"`, "sh", "{{.Source}}", "{{.Destination}}"},
+			flags:     []string{"--batch"},
+			wantDst:   map[string]string{"changed": "new\n", "dir/missing": "new\n"},
+			wantOut:   "Merged: {dst}/changed\nMerged: {dst}/dir/missing\n",
+			assertion: assert.NoError,
+		},
+		{
+			name:      "Error/ContinueOnError",
+			merge:     []string{"false", "{{.Destination}}"},
+			flags:     []string{"--continue-on-error"},
+			wantDst:   map[string]string{"changed": "old\n"},
+			assertion: assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := store.NewMemoryStore()
+			// a pipe is passed to the merge tool as is, like a terminal, without consuming the answers
+			ta := newTestApp(t, WithStore(s), WithIn(helper.Pipe(t, tt.in)))
+			ta.cfg.Merge = tt.merge
+			ta.cfg.MergeBatch = tt.batch
+			helper.CreateDirs(t, filepath.Join(ta.src, "dir"))
+			helper.WriteFile(t, filepath.Join(ta.src, "changed"), []byte("new\n"), 0644)
+			helper.WriteFile(t, filepath.Join(ta.dst, "changed"), []byte("old\n"), 0644)
+			helper.WriteFile(t, filepath.Join(ta.src, "dir", "missing"), []byte("new\n"), 0644)
+
+			out, err := ta.run("merge", tt.flags...)
+			tt.assertion(t, err)
+			for rel, want := range tt.wantDst {
+				got, _ := os.ReadFile(filepath.Join(ta.dst, rel))
+				assert.Equal(t, want, string(got))
+			}
+			for rel, want := range tt.wantSrc {
+				got, _ := os.ReadFile(filepath.Join(ta.src, rel))
+				assert.Equal(t, want, string(got))
+			}
+			if err != nil {
+				// both files are attempted
+				assert.Equal(t, 2, strings.Count(ta.stderr.String(), "Failed:"))
+				return
+			}
+			assert.Equal(t, strings.NewReplacer("{src}", ta.src, "{dst}", ta.dst).Replace(tt.wantOut), out)
+
+			var e *Entry
+			assert.NoError(t, s.Get(store.EntryBucket, filepath.Join(ta.dst, "changed"), &e))
+			sum, _ := e.GetSum()
+			assert.NotEmpty(t, sum)
+		})
+	}
+}
+
+func TestApp_ApplyInteractive(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantDst map[string]string
+	}{
+		{
+			name:    "OK/YesNo",
+			in:      "y\nn\n",
+			wantDst: map[string]string{"a": "new a\n", "b": "old b\n", "c": "old c\n"},
+		},
+		{
+			name:    "OK/DiffAll",
+			in:      "n\nd\na\n",
+			wantDst: map[string]string{"a": "old a\n", "b": "new b\n", "c": "new c\n"},
+		},
+		{
+			name:    "OK/Quit",
+			in:      "x\nq\n",
+			wantDst: map[string]string{"a": "old a\n", "b": "old b\n", "c": "old c\n"},
+		},
+		{
+			name:    "OK/EOF",
+			in:      "y\n",
+			wantDst: map[string]string{"a": "new a\n", "b": "old b\n", "c": "old c\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApp(t, WithIn(strings.NewReader(tt.in)))
+			ta.cfg.Diff = []string{"builtin"}
+			for _, name := range []string{"a", "b", "c"} {
+				helper.WriteFile(t, filepath.Join(ta.src, name), []byte("new "+name+"\n"), 0644)
+				helper.WriteFile(t, filepath.Join(ta.dst, name), []byte("old "+name+"\n"), 0644)
+			}
+
+			_, err := ta.run("apply", "--interactive")
+			assert.NoError(t, err)
+			for rel, want := range tt.wantDst {
+				got, _ := os.ReadFile(filepath.Join(ta.dst, rel))
+				assert.Equal(t, want, string(got), rel)
+			}
+		})
+	}
+}
+
+func TestApp_Watch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "donut.db")
+	ta := newTestApp(t, WithStateFile(file))
+	ta.cfg.Excludes = []string{"ignored"}
+	src, dst := ta.src, ta.dst
+
+	stdout := &bytes.Buffer{}
+	a := ta.app(WithOut(stdout))
+	flags := pflag.NewFlagSet("watch", pflag.ContinueOnError)
+	flags.Duration("delay", 10*time.Millisecond, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Run(ctx, "watch", nil, flags) }()
+
+	// wait for the watcher to start
+	time.Sleep(100 * time.Millisecond)
+	// the store is opened only while the changes are applied
+	s, err := store.Open(file, store.WithLockTimeout(10*time.Millisecond))
+	if assert.NoError(t, err) {
+		assert.NoError(t, s.Close())
+	}
+	helper.WriteFile(t, filepath.Join(src, "a"), []byte("a\n"), 0644)
+	helper.WriteFile(t, filepath.Join(src, "ignored"), []byte("ignored\n"), 0644)
+	helper.CreateDirs(t, filepath.Join(src, "dir"))
+	time.Sleep(100 * time.Millisecond)
+	helper.WriteFile(t, filepath.Join(src, "dir", "b"), []byte("b\n"), 0644)
+
+	assert.Eventually(t, func() bool {
+		a, _ := os.ReadFile(filepath.Join(dst, "a"))
+		b, _ := os.ReadFile(filepath.Join(dst, "dir", "b"))
+		return string(a) == "a\n" && string(b) == "b\n"
+	}, 5*time.Second, 20*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+	assert.NoFileExists(t, filepath.Join(dst, "ignored"))
+	assert.Contains(t, stdout.String(), "Applied: "+filepath.Join(dst, "a"))
+
+	s, err = store.Open(file, store.WithLockTimeout(10*time.Millisecond))
+	if assert.NoError(t, err) {
+		defer s.Close()
+		keys, err := s.Keys(store.EntryBucket)
+		assert.NoError(t, err)
+		assert.Contains(t, keys, filepath.Join(dst, "a"))
+	}
+}
+
+func TestApp_WatchDestinations(t *testing.T) {
+	ta := newTestApp(t)
+	src, dst := ta.src, ta.dst
+	log := filepath.Join(t.TempDir(), "drift.log")
+	ta.cfg.OnDrift = []string{"sh", "-c", `echo "$1 $2" >> "$3"`, "sh", "{{.Destination}}", "{{.Source}}", log}
+	helper.WriteFile(t, filepath.Join(src, "a"), []byte("a\n"), 0644)
+	_, err := ta.run("apply")
+	assert.NoError(t, err)
+
+	stdout := &bytes.Buffer{}
+	a := ta.app(WithOut(stdout))
+	flags := pflag.NewFlagSet("watch", pflag.ContinueOnError)
+	flags.Bool("destinations", true, "")
+	flags.Duration("delay", 10*time.Millisecond, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Run(ctx, "watch", nil, flags) }()
+
+	// wait for the watcher to start
+	time.Sleep(100 * time.Millisecond)
+	helper.WriteFile(t, filepath.Join(dst, "a"), []byte("drifted\n"), 0644)
+	assert.Eventually(t, func() bool {
+		b, _ := os.ReadFile(log)
+		return string(b) == filepath.Join(dst, "a")+" "+filepath.Join(src, "a")+"\n"
+	}, 5*time.Second, 20*time.Millisecond)
+
+	helper.WriteFile(t, filepath.Join(dst, "a"), []byte("a\n"), 0644)
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Contains(t, stdout.String(), "Drifted: "+filepath.Join(dst, "a"))
+	assert.Contains(t, stdout.String(), "Restored: "+filepath.Join(dst, "a"))
+}
+
+func TestApp_ApplyDirectories(t *testing.T) {
+	s := store.NewMemoryStore()
+	ta := newTestApp(t, WithStore(s))
+	ta.cfg.Modes = []config.Mode{{Path: ".ssh", Mode: 0700}}
+	src, dst := ta.src, ta.dst
+	helper.CreateDirs(t, filepath.Join(src, ".ssh"), filepath.Join(src, "empty"))
+	helper.WriteFile(t, filepath.Join(src, ".ssh", "config"), []byte("Host *\n"), 0644)
+	assert.NoError(t, os.Chmod(filepath.Join(src, "empty"), 0750))
+
+	out, err := ta.run("list")
+	assert.NoError(t, err)
+	assert.Equal(t, ".ssh/\n.ssh/config\nempty/\n", out)
+
+	// an existing directory with a looser permission is fixed by the modes config
+	helper.CreateDirs(t, filepath.Join(dst, ".ssh"))
+	_, err = ta.run("apply")
+	assert.NoError(t, err)
+	for rel, want := range map[string]fs.FileMode{".ssh": 0700, "empty": 0750} {
+		info, err := os.Stat(filepath.Join(dst, rel))
+		assert.NoError(t, err)
+		assert.True(t, info.IsDir())
+		assert.Equal(t, want, info.Mode().Perm(), rel)
+	}
+	assert.FileExists(t, filepath.Join(dst, ".ssh", "config"))
+
+	var e *Entry
+	assert.NoError(t, s.Get(store.EntryBucket, filepath.Join(dst, ".ssh"), &e))
+	assert.True(t, e.Mode.IsDir())
+
+	out, err = ta.run("check")
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestApp_ApplyDirectories_Existing(t *testing.T) {
+	ta := newTestApp(t, WithStore(store.NewMemoryStore()))
+	ta.cfg.Modes = []config.Mode{{Path: ".gnupg", Mode: 0700}}
+	src, dst := ta.src, ta.dst
+	helper.CreateDirs(t, filepath.Join(src, ".ssh"), filepath.Join(src, ".gnupg"), filepath.Join(dst, ".ssh"), filepath.Join(dst, ".gnupg"))
+	helper.WriteFile(t, filepath.Join(src, ".ssh", "config"), []byte("Host *\n"), 0644)
+	assert.NoError(t, os.Chmod(filepath.Join(src, ".ssh"), 0755))
+	assert.NoError(t, os.Chmod(filepath.Join(dst, ".ssh"), 0700))
+	assert.NoError(t, os.Chmod(filepath.Join(dst, ".gnupg"), 0755))
+	perm := func(rel string) fs.FileMode {
+		info, err := os.Stat(filepath.Join(dst, rel))
+		assert.NoError(t, err)
+		return info.Mode().Perm()
+	}
+
+	// the mode of the checkout is never copied to an existing directory
+	_, err := ta.run("apply")
+	assert.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0700), perm(".ssh"))
+	assert.Equal(t, fs.FileMode(0700), perm(".gnupg"))
+
+	// the mode changed since the last apply is kept, unless overwritten
+	assert.NoError(t, os.Chmod(filepath.Join(dst, ".gnupg"), 0750))
+	out, err := ta.run("apply")
+	assert.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0750), perm(".gnupg"))
+	assert.Contains(t, out, "Skipped: "+filepath.Join(dst, ".gnupg")+" has been modified since the last apply")
+	_, err = ta.run("apply", "--overwrite")
+	assert.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0700), perm(".gnupg"))
+}
+
+func TestApp_ApplyExact(t *testing.T) {
+	ta := newTestApp(t)
+	// the excludes match the source paths, as for the managed files
+	ta.cfg.Excludes = []string{"exact_lua/*.swp"}
+	ta.cfg.Exact = []string{"plugin"}
+	src, dst := ta.src, ta.dst
+	helper.CreateDirs(t,
+		filepath.Join(src, "exact_lua"),
+		filepath.Join(src, "plugin"),
+		filepath.Join(dst, "lua", "old"),
+		filepath.Join(dst, "plugin"),
+		filepath.Join(dst, "other"),
+	)
+	helper.WriteFile(t, filepath.Join(src, "exact_lua", "init.lua"), []byte("init\n"), 0644)
+	helper.WriteFile(t, filepath.Join(src, "plugin", "p.vim"), []byte("p\n"), 0644)
+	helper.WriteFile(t, filepath.Join(dst, "lua", "stale.lua"), []byte("stale\n"), 0644)
+	helper.WriteFile(t, filepath.Join(dst, "lua", "old", "x.lua"), []byte("x\n"), 0644)
+	helper.WriteFile(t, filepath.Join(dst, "lua", "init.lua.swp"), []byte("swap\n"), 0644)
+	helper.WriteFile(t, filepath.Join(dst, "plugin", "stale.vim"), []byte("stale\n"), 0644)
+	helper.WriteFile(t, filepath.Join(dst, "other", "kept"), []byte("kept\n"), 0644)
+
+	out, err := ta.run("apply")
+	assert.NoError(t, err)
+
+	assert.FileExists(t, filepath.Join(dst, "lua", "init.lua"))
+	assert.FileExists(t, filepath.Join(dst, "lua", "init.lua.swp"))
+	assert.FileExists(t, filepath.Join(dst, "plugin", "p.vim"))
+	assert.FileExists(t, filepath.Join(dst, "other", "kept"))
+	assert.NoFileExists(t, filepath.Join(dst, "lua", "stale.lua"))
+	assert.NoDirExists(t, filepath.Join(dst, "lua", "old"))
+	assert.NoFileExists(t, filepath.Join(dst, "plugin", "stale.vim"))
+	assert.NoDirExists(t, filepath.Join(dst, "exact_lua"))
+	for _, removed := range []string{"lua/old", "lua/stale.lua", "plugin/stale.vim"} {
+		assert.Contains(t, out, "Removed: "+filepath.Join(dst, removed)+"\n")
+	}
+}
+
+func TestApp_ApplyExternals(t *testing.T) {
+	defer config.SetUserHomeDir(t.TempDir())()
+	ta := newTestApp(t)
+	dst, dir := ta.dst, t.TempDir()
+
+	plug := []byte("\" vim-plug\n")
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write(plug)
+	}))
+	defer srv.Close()
+	plugSum := sha256.Sum256(plug)
+
+	archive := filepath.Join(dir, "fonts.tar.gz")
+	helper.WriteTarGz(t, archive, map[string]string{
+		"fonts-1.0/a.ttf":     "a",
+		"fonts-1.0/sub/b.ttf": "b",
+	})
+	ta.cfg.Externals = []config.External{
+		{
+			URL:         srv.URL + "/plug.vim",
+			SHA256:      hex.EncodeToString(plugSum[:]),
+			Destination: ".vim/autoload/plug.vim",
+		},
+		{
+			URL:             "file://" + archive,
+			Type:            config.ExternalTypeArchive,
+			Destination:     ".local/share/fonts",
+			StripComponents: 1,
+		},
+	}
+	apply := func(ta *testApp) string {
+		out, err := ta.run("apply")
+		assert.NoError(t, err)
+		return out
+	}
+	cacheOf := func(ta *testApp) string {
+		a := ta.app()
+		assert.NoError(t, a.ApplyOptions())
+		key := sha256.Sum256([]byte(srv.URL + "/plug.vim"))
+		return filepath.Join(a.externalCacheDir(), hex.EncodeToString(key[:]))
+	}
+
+	cache := cacheOf(ta)
+	assert.Contains(t, apply(ta), "Fetched: "+srv.URL+"/plug.vim\n")
+	got, _ := os.ReadFile(filepath.Join(dst, ".vim", "autoload", "plug.vim"))
+	assert.Equal(t, plug, got)
+	// the cached file and the archive members are streamed to the destinations without being held in memory
+	for _, path := range []string{cache, filepath.Join(dst, ".vim", "autoload", "plug.vim"), filepath.Join(dst, ".local", "share", "fonts", "sub", "b.ttf")} {
+		e, err := entryCache.Get(path)
+		assert.NoError(t, err)
+		assert.Nil(t, e.content, path)
+	}
+	got, _ = os.ReadFile(filepath.Join(dst, ".local", "share", "fonts", "sub", "b.ttf"))
+	assert.Equal(t, "b", string(got))
+
+	// the cached artifacts are used while the refresh period has not passed
+	assert.Empty(t, apply(ta))
+	assert.Equal(t, 1, requests)
+
+	// a cached artifact that does not match the recorded sum is fetched again
+	helper.WriteFile(t, cache, []byte("tampered\n"), 0600)
+	assert.Equal(t, "Fetched: "+srv.URL+"/plug.vim\n", apply(ta))
+	assert.Equal(t, 2, requests)
+	got, _ = os.ReadFile(cache)
+	assert.Equal(t, plug, got)
+
+	// the artifacts are cached per state, as their states are recorded there
+	other := ta.with(WithStateFile(filepath.Join(t.TempDir(), "other.db")))
+	assert.NotEqual(t, cache, cacheOf(other))
+	assert.Contains(t, apply(other), "Fetched: "+srv.URL+"/plug.vim\n")
+	assert.Equal(t, 3, requests)
+	assert.FileExists(t, cacheOf(other))
+
+	// a checksum mismatch fails without touching the destination
+	ta.cfg.Externals[0].SHA256 = strings.Repeat("0", 64)
+	_, err := ta.run("apply")
+	assert.ErrorContains(t, err, "checksum mismatch")
+	got, _ = os.ReadFile(filepath.Join(dst, ".vim", "autoload", "plug.vim"))
+	assert.Equal(t, plug, got)
+}
+
+func TestApp_ApplyView(t *testing.T) {
+	settings := filepath.Join(".config", "Code", "User", "settings.json")
+	equal := func(t assert.TestingT, want, got string, msgAndArgs ...any) bool {
+		return assert.Equal(t, want, got, msgAndArgs...)
+	}
+	tests := []struct {
+		name   string
+		blocks []config.Block
+		patch  []config.Patch
+		path   string
+		src    string
+		dst    string
+		perm   fs.FileMode
+		// the diff shows wantDiff, and none of hidden
+		wantDiff []string
+		hidden   []string
+		want     string
+		// edited is the destination changed outside of the view after the apply, which is no difference
+		edited string
+		// updated is the new source, applied over the edits as wantUpdated
+		updated     string
+		wantUpdated string
+		equal       func(t assert.TestingT, want, got string, msgAndArgs ...any) bool
+	}{
+		{
+			name:        "OK/Block",
+			blocks:      []config.Block{{Path: ".bashrc"}},
+			path:        ".bashrc",
+			src:         "alias ll='ls -l'\n",
+			dst:         "# installer\nexport PATH\n",
+			perm:        0600,
+			wantDiff:    []string{"+alias ll='ls -l'\n"},
+			hidden:      []string{"installer"},
+			want:        "# installer\nexport PATH\n# BEGIN donut\nalias ll='ls -l'\n# END donut\n",
+			edited:      "# installer\nexport PATH\n# BEGIN donut\nalias ll='ls -l'\n# END donut\nexport EDITOR=vim\n",
+			updated:     "alias la='ls -a'\n",
+			wantUpdated: "# installer\nexport PATH\n# BEGIN donut\nalias la='ls -a'\n# END donut\nexport EDITOR=vim\n",
+			equal:       equal,
+		},
+		{
+			name:  "OK/Patch",
+			patch: []config.Patch{{Path: filepath.Join(".config", "Code", "User", "*.json")}},
+			path:  settings,
+			src:   `{"editor.fontSize": 14, "files.exclude": {"**/.git": true}}`,
+			dst:   `{"editor.fontSize": 12, "window.zoomLevel": 1, "files.exclude": {"**/node_modules": true}}`,
+			perm:  0644,
+			// only the managed keys are shown
+			wantDiff: []string{`-  "editor.fontSize": 12,`, `+  "editor.fontSize": 14,`},
+			hidden:   []string{"zoomLevel", "node_modules"},
+			want:     `{"editor.fontSize": 14, "window.zoomLevel": 1, "files.exclude": {"**/.git": true, "**/node_modules": true}}`,
+			// the app rewriting unmanaged keys
+			edited:      `{"editor.fontSize": 14, "window.zoomLevel": 2, "files.exclude": {"**/.git": true}}`,
+			updated:     `{"editor.fontSize": 16, "files.exclude": {"**/.git": true}}`,
+			wantUpdated: `{"editor.fontSize": 16, "window.zoomLevel": 2, "files.exclude": {"**/.git": true}}`,
+			equal:       assert.JSONEq,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApp(t)
+			ta.cfg.Blocks = tt.blocks
+			ta.cfg.Patches = tt.patch
+			ta.cfg.Diff = []string{"builtin"}
+			src, dst := filepath.Join(ta.src, tt.path), filepath.Join(ta.dst, tt.path)
+			helper.CreateDirs(t, filepath.Dir(src), filepath.Dir(dst))
+			helper.WriteFile(t, src, []byte(tt.src), 0644)
+			helper.WriteFile(t, dst, []byte(tt.dst), tt.perm)
+
+			out, err := ta.run("diff")
+			assert.NoError(t, err)
+			for _, s := range tt.wantDiff {
+				assert.Contains(t, out, s)
+			}
+			for _, s := range tt.hidden {
+				assert.NotContains(t, out, s)
+			}
+
+			_, err = ta.run("apply")
+			assert.NoError(t, err)
+			got, _ := os.ReadFile(dst)
+			tt.equal(t, tt.want, string(got))
+			info, _ := os.Stat(dst)
+			assert.Equal(t, tt.perm, info.Mode().Perm())
+
+			// changes outside of the view are neither differences nor modifications
+			helper.WriteFile(t, dst, []byte(tt.edited), tt.perm)
+			_, err = ta.run("check")
+			assert.NoError(t, err)
+
+			helper.WriteFile(t, src, []byte(tt.updated), 0644)
+			out, err = ta.run("apply")
+			assert.NoError(t, err)
+			assert.Contains(t, out, "Applied: ")
+			got, _ = os.ReadFile(dst)
+			tt.equal(t, tt.wantUpdated, string(got))
+		})
+	}
+}
+
+func TestApp_ApplyRemove_Unsafe(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		wantErr string
+	}{
+		{name: "Error/Destination", list: ".\n", wantErr: "not a path in the destination directory"},
+		{name: "Error/DestinationParent", list: "a/..\n", wantErr: "not a path in the destination directory"},
+		{name: "Error/DestinationSlash", list: "./\n", wantErr: "not a path in the destination directory"},
+		{name: "Error/Managed", list: ".config\n", wantErr: "is managed by"},
+		{name: "OK/Directory", list: ".cache\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApp(t, WithStore(store.NewMemoryStore()))
+			src, dst := ta.src, ta.dst
+			helper.CreateDirs(t, filepath.Join(src, ".config"), filepath.Join(dst, ".cache"))
+			helper.WriteFile(t, filepath.Join(src, ".config", "kept"), []byte("kept\n"), 0644)
+			helper.WriteFile(t, filepath.Join(src, ".donutremove"), []byte(tt.list), 0644)
+			helper.WriteFile(t, filepath.Join(dst, ".cache", "data"), []byte("data\n"), 0644)
+
+			out, err := ta.run("apply")
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				assert.DirExists(t, dst)
+				assert.NoFileExists(t, filepath.Join(dst, ".config", "kept"))
+				return
+			}
+			// a directory is removed with its contents only if it is listed with a trailing slash
+			assert.NoError(t, err)
+			assert.Contains(t, out, "Skipped: "+filepath.Join(dst, ".cache")+" is not empty")
+			assert.FileExists(t, filepath.Join(dst, ".cache", "data"))
+		})
+	}
+}
+
+func TestApp_ApplyRemove(t *testing.T) {
+	ta := newTestApp(t)
+	ta.cfg.Diff = []string{"diff", "-u", "{{.Destination}}", "{{.Source}}"}
+	src, dst := ta.src, ta.dst
+	helper.CreateDirs(t,
+		filepath.Join(src, ".config"),
+		filepath.Join(dst, ".config", "oldtool"),
+	)
+	helper.WriteFile(t, filepath.Join(src, "remove_.zprofile"), nil, 0644)
+	helper.WriteFile(t, filepath.Join(src, ".donutremove"), []byte("# deprecated\n.config/oldtool/\n\n.missing\n"), 0644)
+	helper.WriteFile(t, filepath.Join(src, ".config", "kept"), []byte("kept\n"), 0644)
+	helper.WriteFile(t, filepath.Join(dst, ".zprofile"), []byte("export OLD=1\n"), 0644)
+	helper.WriteFile(t, filepath.Join(dst, ".config", "oldtool", "config"), []byte("old\n"), 0644)
+
+	out, err := ta.run("list")
+	assert.NoError(t, err)
+	assert.Equal(t, ".config/\n.config/kept\n"+
+		filepath.Join(dst, ".zprofile")+" (remove)\n"+
+		filepath.Join(dst, ".config", "oldtool")+" (remove)\n", out)
+
+	out, err = ta.run("diff", "--no-pager")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "--- "+filepath.Join(dst, ".zprofile")+"\n+++ /dev/null\n@@ -1 +0,0 @@\n-export OLD=1\n")
+	assert.Contains(t, out, "directory "+filepath.Join(dst, ".config", "oldtool")+"\ndeleted\n")
+	assert.NotContains(t, out, ".missing")
+
+	out, err = ta.run("apply")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "Removed: "+filepath.Join(dst, ".zprofile")+"\n")
+	assert.Contains(t, out, "Removed: "+filepath.Join(dst, ".config", "oldtool")+"\n")
+	assert.NoFileExists(t, filepath.Join(dst, ".zprofile"))
+	assert.NoFileExists(t, filepath.Join(dst, "remove_.zprofile"))
+	assert.NoFileExists(t, filepath.Join(dst, ".donutremove"))
+	assert.NoDirExists(t, filepath.Join(dst, ".config", "oldtool"))
+	assert.FileExists(t, filepath.Join(dst, ".config", "kept"))
+
+	out, err = ta.run("list")
+	assert.NoError(t, err)
+	assert.Equal(t, ".config/\n.config/kept\n", out)
+}
+
+func TestApp_WithStore(t *testing.T) {
+	applied, other := store.NewMemoryStore(), store.NewMemoryStore()
+	ta := newTestApp(t)
+	helper.WriteFile(t, filepath.Join(ta.src, ".vimrc"), []byte("set number\n"), 0644)
+
+	_, err := ta.with(WithStore(applied)).run("apply")
+	assert.NoError(t, err)
+	keys, err := applied.Keys(store.EntryBucket)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(ta.dst, ".vimrc")}, keys)
+	keys, err = other.Keys(store.EntryBucket)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	// the destination modified after the apply is skipped only with the store that recorded it
+	helper.WriteFile(t, filepath.Join(ta.dst, ".vimrc"), []byte("set nonumber\n"), 0644)
+	for _, tt := range []struct {
+		store store.Store
+		want  string
+	}{
+		{store: applied, want: "Skipped: "},
+		{store: other, want: "Applied: "},
+	} {
+		out, err := ta.with(WithStore(tt.store)).run("apply")
+		assert.NoError(t, err)
+		assert.Contains(t, out, tt.want)
+	}
+}
+
+func TestApp_ApplyBatched(t *testing.T) {
+	s := &countingStore{Store: store.NewMemoryStore()}
+	ta := newTestApp(t, WithStore(s))
+	helper.WriteFile(t, filepath.Join(ta.src, ".vimrc"), []byte("set number\n"), 0644)
+	helper.WriteFile(t, filepath.Join(ta.src, ".bashrc"), []byte("export EDITOR=vim\n"), 0644)
+
+	_, err := ta.run("apply")
+	assert.NoError(t, err)
+
+	// the files are recorded in a single write
+	assert.Equal(t, 0, s.sets)
+	assert.Equal(t, 1, s.writes)
+	keys, err := s.Keys(store.EntryBucket)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(ta.dst, ".bashrc"), filepath.Join(ta.dst, ".vimrc")}, keys)
+}
+
+func TestApp_Blobs(t *testing.T) {
+	s := store.NewMemoryStore()
+	// the blobs are kept next to the state file
+	stateFile := filepath.Join(t.TempDir(), "donut.db")
+	ta := newTestApp(t, WithStore(s), WithStateFile(stateFile))
+	ta.cfg.DiffContext = 3
+	src, dst := ta.src, ta.dst
+	helper.WriteFile(t, filepath.Join(src, ".vimrc"), []byte("set number\n"), 0644)
+	vimrc := filepath.Join(dst, ".vimrc")
+	applied := func() string {
+		var e *Entry
+		assert.NoError(t, s.Get(store.EntryBucket, vimrc, &e))
+		return e.Blob
+	}
+	blobOf := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+
+	_, err := ta.run("apply")
+	assert.NoError(t, err)
+	assert.Equal(t, blobOf("set number\n"), applied())
+	blobs := &blobStore{dir: filepath.Join(filepath.Dir(stateFile), "donut.blobs")}
+	sums, err := blobs.Sums()
+	assert.NoError(t, err)
+	assert.Len(t, sums, 1)
+
+	// the changes of the destination since the apply are compared with the applied content
+	helper.WriteFile(t, vimrc, []byte("set nonumber\n"), 0644)
+	out, err := ta.run("diff", "--since-apply", "--exit-code")
+	assert.ErrorIs(t, err, ErrDiffFound)
+	assert.Contains(t, out, "--- "+vimrc+" (applied)")
+	assert.Contains(t, out, "-set number\n+set nonumber\n")
+
+	// the applied content is restored over the changes, and over a removal
+	for _, change := range []func(){
+		func() { helper.WriteFile(t, vimrc, []byte("set nonumber\n"), 0644) },
+		func() { assert.NoError(t, os.Remove(vimrc)) },
+	} {
+		change()
+		out, err = ta.run("restore", dst)
+		assert.NoError(t, err)
+		assert.Equal(t, "Restored: "+vimrc+"\n", out)
+		got, _ := os.ReadFile(vimrc)
+		assert.Equal(t, "set number\n", string(got))
+	}
+	out, err = ta.run("restore", vimrc)
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+	_, err = ta.run("restore", filepath.Join(dst, ".bashrc"))
+	assert.ErrorContains(t, err, "no applied content recorded")
+
+	// the replaced content is no longer referenced, and gc removes it
+	helper.WriteFile(t, filepath.Join(src, ".vimrc"), []byte("set number relativenumber\n"), 0644)
+	_, err = ta.run("apply", "--overwrite")
+	assert.NoError(t, err)
+	assert.Equal(t, blobOf("set number relativenumber\n"), applied())
+
+	out, err = ta.run("gc", "--dry-run")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "Pending: ")
+	sums, _ = blobs.Sums()
+	assert.Len(t, sums, 2)
+
+	out, err = ta.run("gc")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "Deleted: ")
+	sums, _ = blobs.Sums()
+	assert.Equal(t, []string{blobOf("set number relativenumber\n")}, sums)
+
+	out, err = ta.run("diff", "--since-apply")
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestApp_Hash(t *testing.T) {
+	s := store.NewMemoryStore()
+	ta := newTestApp(t, WithStore(s))
+	src, dst := ta.src, ta.dst
+	helper.WriteFile(t, filepath.Join(src, ".vimrc"), []byte("set number\n"), 0644)
+	helper.WriteFile(t, filepath.Join(src, ".bashrc"), []byte("export EDITOR=vim\n"), 0644)
+	apply := func() string {
+		out, err := ta.run("apply")
+		assert.NoError(t, err)
+		return out
+	}
+	hash := func(name string) string {
+		var got map[string]any
+		assert.NoError(t, s.Get(store.EntryBucket, filepath.Join(dst, name), &got))
+		return got["hash"].(string)
+	}
+
+	assert.Contains(t, apply(), "Applied: ")
+	assert.Equal(t, config.HashSHA256, hash(".vimrc"))
+
+	// the sums recorded with the previous algorithm are compared with the destinations hashed with it
+	ta.cfg.Hash = config.HashMD5
+	helper.WriteFile(t, filepath.Join(dst, ".vimrc"), []byte("set nonumber\n"), 0644)
+	helper.WriteFile(t, filepath.Join(src, ".bashrc"), []byte("export EDITOR=nvim\n"), 0644)
+	out := apply()
+	assert.Contains(t, out, "Skipped: "+filepath.Join(dst, ".vimrc"))
+	assert.Contains(t, out, "Applied: "+filepath.Join(dst, ".bashrc"))
+	assert.Equal(t, config.HashSHA256, hash(".vimrc"))
+	assert.Equal(t, config.HashMD5, hash(".bashrc"))
+
+	// the unchanged destinations are recorded again with the new algorithm, instead of being taken as modified
+	ta.cfg.Hash = config.HashXXH64
+	helper.WriteFile(t, filepath.Join(dst, ".vimrc"), []byte("set number\n"), 0644)
+	assert.Empty(t, apply())
+	assert.Equal(t, config.HashXXH64, hash(".vimrc"))
+	assert.Equal(t, config.HashXXH64, hash(".bashrc"))
+	var e *Entry
+	assert.NoError(t, s.Get(store.EntryBucket, filepath.Join(dst, ".bashrc"), &e))
+	got, err := e.GetSum()
+	assert.NoError(t, err)
+	assert.Equal(t, binary.BigEndian.AppendUint64(nil, xxhash.Sum64([]byte("export EDITOR=nvim\n"))), got)
+
+	// the destinations are compared with the recorded sums of the new algorithm
+	helper.WriteFile(t, filepath.Join(dst, ".vimrc"), []byte("set nonumber\n"), 0644)
+	assert.Contains(t, apply(), "Skipped: "+filepath.Join(dst, ".vimrc"))
+}
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	helper.WriteFile(t, src, []byte("set number\n"), 0644)
+	read := func() []byte {
+		b, err := os.ReadFile(dst)
+		assert.NoError(t, err)
+		return b
+	}
+
+	entryCache = &EntryCache{}
+	de, err := copyFile(src, dst, os.ModePerm)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("set number\n"), read())
+	want := sha256.Sum256([]byte("set number\n"))
+	sum, err := de.GetSum()
+	assert.NoError(t, err)
+	assert.Equal(t, want[:], sum)
+	// the source is streamed without being cached
+	se, _ := entryCache.Get(src)
+	assert.Nil(t, se.content)
+
+	// the destination is left untouched if the source changes after it was hashed
+	helper.WriteFile(t, src, []byte("set nonumber\n"), 0644)
+	_, err = copyFile(src, dst, os.ModePerm)
+	assert.ErrorContains(t, err, "has been changed while applying")
+	assert.Equal(t, []byte("set number\n"), read())
+}
+
+// countingStore counts the writes to the store.
+type countingStore struct {
+	store.Store
+	sets   int
+	writes int
+}
+
+func (s *countingStore) Set(bucket string, key string, value any) error {
+	s.sets++
+	return s.Store.Set(bucket, key, value)
+}
+
+func (s *countingStore) Write(b *store.Batch) error {
+	s.writes++
+	return s.Store.Write(b)
+}
+
+func TestApp_MigrateState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "donut.json")
+	// a state written before the schema versioning
+	helper.WriteFile(t, file, []byte(`{"entries": {}}`), 0600)
+	s, err := store.OpenJSON(file, store.WithManualMigration())
+	if !assert.NoError(t, err) {
+		return
+	}
+	run := func(dryRun bool) string {
+		stdout := &bytes.Buffer{}
+		flags := pflag.NewFlagSet("migrate", pflag.ContinueOnError)
+		flags.Bool("dry-run", dryRun, "")
+		a := NewApp(WithStore(s), WithOut(stdout))
+		assert.NoError(t, a.Run(context.Background(), "state migrate", nil, flags))
+		return stdout.String()
+	}
+
+	assert.Equal(t, "Pending: version 1: record the schema version in the meta bucket\n"+
+		"Pending: version 2: count the references of the blobs of the applied contents\n"+
+		"Pending: version 3: record the hash algorithm next to the sums of the entries\n"+
+		"Pending: version 4: drop the reference counts of the blobs, which gc finds from the entries\n", run(true))
+	assert.Equal(t, "Migrated: version 1: record the schema version in the meta bucket\n"+
+		"Migrated: version 2: count the references of the blobs of the applied contents\n"+
+		"Migrated: version 3: record the hash algorithm next to the sums of the entries\n"+
+		"Migrated: version 4: drop the reference counts of the blobs, which gc finds from the entries\n", run(false))
+	assert.Equal(t, "State schema is up to date: version 4\n", run(true))
+}
+
+func TestApp_State(t *testing.T) {
+	s := store.NewMemoryStore()
+	dir := t.TempDir()
+	for _, key := range []string{"nvim/init.lua", "nvim/lua/a.lua", "nvim2", "zshrc"} {
+		assert.NoError(t, s.Set(store.EntryBucket, filepath.Join(dir, key), map[string]any{"empty": false}))
+	}
+	run := func(command string, args ...string) (string, error) {
+		stdout := &bytes.Buffer{}
+		flags := pflag.NewFlagSet(command, pflag.ContinueOnError)
+		flags.String("bucket", store.EntryBucket, "")
+		a := NewApp(WithStore(s), WithOut(stdout))
+		err := a.Run(context.Background(), command, args, flags)
+		return stdout.String(), err
+	}
+
+	out, err := run("state get", filepath.Join(dir, "zshrc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "{\n  \"empty\": false\n}\n", out)
+	_, err = run("state get", filepath.Join(dir, "missing"))
+	assert.ErrorContains(t, err, "not found")
+
+	_, err = run("state set", filepath.Join(dir, "zshrc"), `{"empty": true}`)
+	assert.NoError(t, err)
+	out, _ = run("state get", filepath.Join(dir, "zshrc"))
+	assert.Equal(t, "{\n  \"empty\": true\n}\n", out)
+	_, err = run("state set", filepath.Join(dir, "zshrc"), `{`)
+	assert.ErrorContains(t, err, "invalid JSON")
+
+	// the siblings sharing the prefix are kept
+	out, err = run("state forget", filepath.Join(dir, "nvim"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Forgot: "+filepath.Join(dir, "nvim", "init.lua")+"\nForgot: "+filepath.Join(dir, "nvim", "lua", "a.lua")+"\n", out)
+
+	_, err = run("state delete", filepath.Join(dir, "nvim2"))
+	assert.NoError(t, err)
+	keys, _ := s.Keys(store.EntryBucket)
+	assert.Equal(t, []string{filepath.Join(dir, "zshrc")}, keys)
+
+	file := filepath.Join(t.TempDir(), "state.json")
+	_, err = run("state export", file)
+	assert.NoError(t, err)
+	s = store.NewMemoryStore()
+	out, err = run("state import", file)
+	assert.NoError(t, err)
+	assert.Equal(t, "Imported: 1 values\n", out)
+	keys, _ = s.Keys(store.EntryBucket)
+	assert.Equal(t, []string{filepath.Join(dir, "zshrc")}, keys)
+
+	helper.WriteFile(t, file, []byte(`{"meta": {"schema_version": 0}, "entries": {}}`), 0600)
+	_, err = run("state import", file)
+	assert.ErrorContains(t, err, "migrate the older one first")
+
+	flags := pflag.NewFlagSet("dump", pflag.ContinueOnError)
+	flags.String("bucket", store.MetaBucket, "")
+	stdout := &bytes.Buffer{}
+	assert.NoError(t, NewApp(WithStore(s), WithOut(stdout)).Run(context.Background(), "state dump", nil, flags))
+	assert.JSONEq(t, fmt.Sprintf(`{"schema_version": %d}`, store.SchemaVersion), stdout.String())
+}
+
+func TestApp_StatePath(t *testing.T) {
+	home := t.TempDir()
+	defer config.SetUserHomeDir(home)()
+	stateDir := filepath.Join(home, ".local", "state", "donut")
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		config *config.Config
+		want   string
+	}{
+		{
+			name:   "OK/DefaultFile",
+			config: &config.Config{File: filepath.Join(home, ".config", "donut", "donut.toml")},
+			want:   filepath.Join(stateDir, "donut.db"),
+		},
+		{
+			name:   "OK/File",
+			config: &config.Config{File: "/path/to/work.toml"},
+			want:   filepath.Join(stateDir, "work-f8dbc64291df.db"),
+		},
+		{
+			name:   "OK/Setting",
+			config: &config.Config{File: "/path/to/work.toml", State: "/path/to/work.json"},
+			want:   "/path/to/work.json",
+		},
+		{
+			name:   "OK/Option",
+			opts:   []Option{WithStateFile("/path/to/other.db")},
+			config: &config.Config{File: "/path/to/work.toml", State: "/path/to/work.json"},
+			want:   "/path/to/other.db",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewApp(append(tt.opts, WithConfig(tt.config))...)
+			assert.NoError(t, a.ApplyOptions())
+			assert.Equal(t, tt.want, a.statePath())
+		})
+	}
+}
+
+func TestApp_AdoptLegacyState(t *testing.T) {
+	tests := []struct {
+		name string
+		// defaultFile is true if the default config file owns the legacy state
+		defaultFile bool
+		want        string
+	}{
+		{name: "OK/Moved", want: "set nonumber\n"},
+		{name: "OK/OwnedByDefault", defaultFile: true, want: "set number\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			defer config.SetUserHomeDir(home)()
+			t.Setenv("XDG_CONFIG_HOME", "")
+			if tt.defaultFile {
+				helper.CreateDirs(t, filepath.Join(home, ".config", "donut"))
+				helper.WriteFile(t, config.DefaultConfigFile(), nil, 0644)
+			}
+			ta := newTestApp(t)
+			ta.cfg.File = filepath.Join(home, "work.toml")
+			helper.WriteFile(t, filepath.Join(ta.src, ".vimrc"), []byte("set number\n"), 0644)
+
+			// applied by a version sharing the state file among the configs
+			legacy := store.DefaultDBFile()
+			_, err := ta.with(WithStateFile(legacy)).run("apply")
+			assert.NoError(t, err)
+			vimrc := filepath.Join(ta.dst, ".vimrc")
+			helper.WriteFile(t, vimrc, []byte("set nonumber\n"), 0644)
+
+			// the locally edited destination is not overwritten after the upgrade,
+			// unless the legacy state belongs to the default config
+			_, err = ta.run("apply")
+			assert.NoError(t, err)
+			stderr := ta.stderr.String()
+			a := ta.app()
+			assert.NoError(t, a.ApplyOptions())
+			derived := a.statePath()
+			got, err := os.ReadFile(vimrc)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+			assert.FileExists(t, derived)
+			if tt.defaultFile {
+				assert.Empty(t, stderr)
+				assert.FileExists(t, legacy)
+				return
+			}
+			assert.Contains(t, stderr, "Moved: "+derived+" from "+legacy)
+			assert.NoFileExists(t, legacy)
+		})
+	}
+}
+
+func TestApp_Locked(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "donut.db")
+	ta := newTestApp(t, WithStateFile(file))
+	helper.WriteFile(t, filepath.Join(ta.src, ".vimrc"), []byte("set number\n"), 0644)
+	held, err := store.Open(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer held.Close()
+
+	// the commands not using the store never wait
+	out, err := ta.run("list")
+	assert.NoError(t, err)
+	assert.Equal(t, ".vimrc\n", out)
+
+	var locked *store.LockedError
+	_, err = ta.run("apply")
+	assert.ErrorAs(t, err, &locked)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	waiting := ta.with(WithWait())
+	_, err = waiting.runContext(ctx, "apply")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, waiting.stderr.String(), "Waiting: another donut process")
+	assert.NoFileExists(t, filepath.Join(ta.dst, ".vimrc"))
+}
+
+func TestApp_CheckSumCache(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "donut.db")
+	ta := newTestApp(t, WithStateFile(file))
+	src, dst := ta.src, ta.dst
+	helper.WriteFile(t, filepath.Join(src, ".vimrc"), []byte("set number\n"), 0644)
+	run := func(command string, args ...string) error {
+		_, err := ta.run(command, args...)
+		return err
+	}
+	sums := func() []string {
+		s, err := store.Open(file, store.WithLockTimeout(time.Nanosecond))
+		if !assert.NoError(t, err, "the store is not held after the run") {
+			return nil
+		}
+		defer s.Close()
+		keys, err := s.Keys(store.SumBucket)
+		assert.NoError(t, err)
+		return keys
+	}
+
+	// the state file is not created by check
+	assert.Error(t, run("check"))
+	assert.NoFileExists(t, file)
+
+	assert.NoError(t, run("apply"))
+	old := time.Now().Add(-time.Hour)
+	for _, path := range []string{filepath.Join(src, ".vimrc"), filepath.Join(dst, ".vimrc")} {
+		assert.NoError(t, os.Chtimes(path, old, old))
+	}
+
+	// the sums are not written while another process holds the lock
+	held, err := store.Open(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, run("check"))
+	assert.NoError(t, held.Close())
+	assert.Empty(t, sums())
+
+	assert.NoError(t, run("check"))
+	assert.ElementsMatch(t, []string{filepath.Join(src, ".vimrc"), filepath.Join(dst, ".vimrc")}, sums())
+
+	// the sums are deleted with the entries, and by gc once the files no longer exist
+	assert.NoError(t, run("state forget", filepath.Join(dst, ".vimrc")))
+	assert.Equal(t, []string{filepath.Join(src, ".vimrc")}, sums())
+	assert.NoError(t, os.Remove(filepath.Join(src, ".vimrc")))
+	assert.NoError(t, run("gc"))
+	assert.Empty(t, sums())
+}
+
+func TestApp_Ask(t *testing.T) {
+	in := strings.NewReader("Y\nrest of the input\n")
+	a := NewApp(WithIn(in), WithOut(&bytes.Buffer{}))
+	assert.NoError(t, a.ApplyOptions())
+	ok, err := a.confirm("Apply?")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// the input after the answer is left to the child processes
+	rest, err := io.ReadAll(in)
+	assert.NoError(t, err)
+	assert.Equal(t, "rest of the input\n", string(rest))
+
+	ok, err = a.confirm("Apply?")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
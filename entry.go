@@ -1,7 +1,6 @@
 package donut
 
 import (
-	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,16 +8,26 @@ import (
 	"io/fs"
 	"time"
 
+	"github.com/nishikirb/donut/config"
 	"github.com/nishikirb/donut/system"
 )
 
 type Entry struct {
-	Path      string      `json:"-"`
-	Empty     bool        `json:"empty"`
-	Mode      fs.FileMode `json:"mode"`
-	ModTime   time.Time   `json:"mod_time"`
-	sum       []byte
-	content   []byte
+	Path    string      `json:"-"`
+	Empty   bool        `json:"empty"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	// Blob is the sum of the applied content kept in the blob store, if recorded
+	Blob  string `json:"blob,omitempty"`
+	size  int64
+	inode uint64
+	sum   []byte
+	// hash is the algorithm of the sum, which is sha256 if empty
+	hash    string
+	content []byte
+	view    View
+	// sums caches the sum across runs while the stat of the file is unchanged
+	sums      *sumCache
 	isFetched bool `json:"-"`
 }
 
@@ -43,23 +52,62 @@ func NewEntry(path string) (*Entry, error) {
 		Empty:   false,
 		Mode:    f.Mode(),
 		ModTime: f.ModTime(),
+		size:    f.Size(),
+		inode:   system.Inode(f),
 	}, nil
 }
 
+// GetSum returns the checksum of the file. It is nil for a directory or a missing file.
+// If the entry has a view, it is the checksum of the view, which is nil if the view is not found.
 func (e *Entry) GetSum() ([]byte, error) {
-	if e == nil || e.Empty {
+	if e == nil || e.Empty || e.Mode.IsDir() {
 		return nil, nil
 	}
 	if e.sum == nil && !e.isFetched {
-		if err := e.loadSum(); err != nil {
+		if e.view != nil {
+			// the whole content is needed to extract the view
+			if err := e.loadContent(); err != nil {
+				return nil, err
+			}
+		} else if sum, ok := e.sums.lookup(e); ok {
+			e.sum = sum
+		} else if err := e.loadSum(); err != nil {
 			return nil, err
+		} else {
+			e.sums.add(e, e.sum)
 		}
 	}
 	return e.sum, nil
 }
 
+// algorithm returns the name of the algorithm of the sum.
+func (e *Entry) algorithm() string {
+	if e.hash == "" {
+		return config.HashSHA256
+	}
+	return e.hash
+}
+
+// sumWith returns the checksum of the file computed with the algorithm, which is
+// the checksum returned by GetSum if the entry uses the same algorithm.
+func (e *Entry) sumWith(algorithm string) ([]byte, error) {
+	if e == nil || algorithm == e.algorithm() {
+		return e.GetSum()
+	}
+	other := &Entry{
+		Path:    e.Path,
+		Empty:   e.Empty,
+		Mode:    e.Mode,
+		ModTime: e.ModTime,
+		view:    e.view,
+		hash:    algorithm,
+	}
+	return other.GetSum()
+}
+
+// GetContent returns the content of the file. It is nil for a directory or a missing file.
 func (e *Entry) GetContent() ([]byte, error) {
-	if e == nil || e.Empty {
+	if e == nil || e.Empty || e.Mode.IsDir() {
 		return nil, nil
 	}
 	if e.content == nil && !e.isFetched {
@@ -70,10 +118,6 @@ func (e *Entry) GetContent() ([]byte, error) {
 	return e.content, nil
 }
 
-// func (e *Entry) isDir() bool {
-// 	return e.Mode.IsDir()
-// }
-
 // func (e *Entry) isSymLink() bool {
 // 	return e.Mode&os.ModeSymlink != 0
 // }
@@ -89,6 +133,23 @@ func (e *Entry) GetContent() ([]byte, error) {
 // 	return l == path, nil
 // }
 
+// release frees the content of the file, which is read again if needed. The sum is kept.
+func (e *Entry) release() {
+	if e != nil {
+		e.content = nil
+	}
+}
+
+// GetView returns the content of the view if the entry has a view, otherwise the whole content.
+func (e *Entry) GetView() ([]byte, error) {
+	content, err := e.GetContent()
+	if err != nil || e.view == nil {
+		return content, err
+	}
+	view, _ := e.view.Extract(content)
+	return view, nil
+}
+
 // MarshalJSON implements json.Marshaler interface.
 func (e *Entry) MarshalJSON() ([]byte, error) {
 	type Alias Entry // エイリアスを作成して、再帰的な呼び出しを避ける
@@ -99,10 +160,12 @@ func (e *Entry) MarshalJSON() ([]byte, error) {
 	}
 	return json.Marshal(&struct {
 		*Alias
-		Sum []byte `json:"sum"`
+		Sum  []byte `json:"sum"`
+		Hash string `json:"hash"`
 	}{
 		Alias: (*Alias)(e),
 		Sum:   sum,
+		Hash:  e.algorithm(),
 	})
 }
 
@@ -112,7 +175,8 @@ func (e *Entry) UnmarshalJSON(value []byte) error {
 
 	aux := &struct {
 		*Alias
-		Sum []byte `json:"sum"`
+		Sum  []byte `json:"sum"`
+		Hash string `json:"hash"`
 	}{
 		Alias: (*Alias)(e),
 	}
@@ -121,6 +185,8 @@ func (e *Entry) UnmarshalJSON(value []byte) error {
 	}
 
 	e.sum = aux.Sum
+	// the sums recorded before the algorithm was recorded are sha256
+	e.hash = aux.Hash
 	e.isFetched = true
 	return nil
 }
@@ -131,7 +197,10 @@ func (e *Entry) loadSum() error {
 		return err
 	}
 	defer file.Close()
-	h := sha256.New()
+	h, err := newHash(e.hash)
+	if err != nil {
+		return err
+	}
 	if _, err := io.Copy(h, file); err != nil {
 		return err
 	}
@@ -144,11 +213,20 @@ func (e *Entry) loadContent() error {
 	if err != nil {
 		return err
 	}
-	h := sha256.New()
-	if _, err := h.Write(r); err != nil {
+	e.content = r
+
+	if e.view != nil {
+		view, ok := e.view.Extract(r)
+		if !ok {
+			e.sum = nil
+			return nil
+		}
+		r = view
+	}
+	sum, err := sumOf(e.hash, r)
+	if err != nil {
 		return err
 	}
-	e.content = r
-	e.sum = h.Sum(nil)
+	e.sum = sum
 	return nil
 }
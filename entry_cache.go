@@ -6,6 +6,11 @@ import (
 
 type EntryCache struct {
 	cache sync.Map
+	views sync.Map
+	// sums is set while the store is open, see SetSums
+	sums *sumCache
+	// hash is the algorithm of the sums of the new entries, see SetHash
+	hash string
 }
 
 var entryCache = &EntryCache{}
@@ -14,7 +19,7 @@ func (c *EntryCache) Get(path string) (*Entry, error) {
 	if v, ok := c.cache.Load(path); ok {
 		return v.(*Entry), nil
 	}
-	if f, err := NewEntry(path); err != nil {
+	if f, err := c.newEntry(path); err != nil {
 		return nil, err
 	} else {
 		c.Set(path, f)
@@ -35,10 +40,39 @@ func (c *EntryCache) Set(path string, f *Entry) {
 }
 
 func (c *EntryCache) Reload(path string) (*Entry, error) {
-	if f, err := NewEntry(path); err != nil {
+	if f, err := c.newEntry(path); err != nil {
 		return nil, err
 	} else {
 		c.Set(path, f)
 		return f, nil
 	}
 }
+
+// SetView makes the entry of path manage only the view.
+func (c *EntryCache) SetView(path string, v View) {
+	c.views.Store(path, v)
+	c.cache.Delete(path)
+}
+
+// SetSums makes the new entries reuse the sums of the cache, or stops it if sums is nil.
+func (c *EntryCache) SetSums(sums *sumCache) {
+	c.sums = sums
+}
+
+// SetHash makes the new entries compute their sums with the algorithm.
+func (c *EntryCache) SetHash(algorithm string) {
+	c.hash = algorithm
+}
+
+func (c *EntryCache) newEntry(path string) (*Entry, error) {
+	e, err := NewEntry(path)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := c.views.Load(path); ok {
+		e.view = v.(View)
+	}
+	e.sums = c.sums
+	e.hash = c.hash
+	return e, nil
+}
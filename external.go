@@ -0,0 +1,361 @@
+package donut
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nishikirb/donut/config"
+	"github.com/nishikirb/donut/store"
+	"github.com/nishikirb/donut/system"
+)
+
+// defaultExternalMode is the permission of the files of an external when not configured.
+const defaultExternalMode fs.FileMode = 0644
+
+// externalState is the state of a fetched external recorded in the store.
+type externalState struct {
+	Sum       []byte    `json:"sum"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// errNotWritten aborts the write of an archive member that is unchanged or skipped, see applyFrom.
+var errNotWritten = errors.New("not written")
+
+// externalCacheDir returns the directory where the fetched externals are cached. It is next to the state file,
+// as the states of the fetched externals are recorded there.
+func (a *App) externalCacheDir() string {
+	state := a.statePath()
+	return strings.TrimSuffix(state, filepath.Ext(state)) + ".externals"
+}
+
+// applyExternals fetches the externals if needed, and applies them to the destinations.
+func (a *App) applyExternals(ctx context.Context, overwrite, interactive bool) error {
+	for _, e := range a.config.Externals {
+		if interactive {
+			if ok, err := a.confirm("Apply external %s to %s?", e.URL, a.externalDestination(e)); err != nil {
+				return err
+			} else if !ok {
+				fmt.Fprintf(a.out, "Skipped: %s\n", e.URL)
+				continue
+			}
+		}
+
+		cache, err := a.fetchExternal(ctx, e)
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.URL, err)
+		}
+		if e.Type == config.ExternalTypeArchive {
+			err = a.extractExternal(cache, e, overwrite)
+		} else {
+			err = a.applyExternalFile(cache, e, overwrite)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.URL, err)
+		}
+	}
+	return nil
+}
+
+// fetchExternal returns the path of the cached artifact of e, fetching it when it is not
+// cached yet, the refresh period has passed, or the cached one does not match the checksum
+// or the recorded sum.
+func (a *App) fetchExternal(ctx context.Context, e config.External) (string, error) {
+	dir := a.externalCacheDir()
+	key := sha256.Sum256([]byte(e.URL))
+	cache := filepath.Join(dir, hex.EncodeToString(key[:]))
+
+	var st *externalState
+	if err := a.store.Get(store.ExternalBucket, e.URL, &st); err != nil {
+		return "", err
+	}
+	if st != nil {
+		fresh := e.Refresh == 0 || time.Since(st.FetchedAt) < e.Refresh
+		verified := e.SHA256 == "" || strings.EqualFold(hex.EncodeToString(st.Sum), e.SHA256)
+		if fresh && verified {
+			sum, err := sha256File(cache)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return "", err
+			}
+			if bytes.Equal(sum, st.Sum) {
+				return cache, nil
+			}
+		}
+	}
+
+	r, err := openExternal(ctx, e.URL)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	if err := system.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	verify := func() error {
+		if sum := hex.EncodeToString(h.Sum(nil)); e.SHA256 != "" && !strings.EqualFold(sum, e.SHA256) {
+			return fmt.Errorf("checksum mismatch: expected %s, got %s", e.SHA256, sum)
+		}
+		return nil
+	}
+	if err := system.OverwriteFrom(cache, io.TeeReader(r, h), 0600, verify); err != nil {
+		return "", err
+	}
+	if _, err := entryCache.Reload(cache); err != nil {
+		return "", err
+	}
+
+	if err := a.storeSet(store.ExternalBucket, e.URL, &externalState{
+		Sum:       h.Sum(nil),
+		FetchedAt: time.Now(),
+	}); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(a.out, "Fetched: %s\n", e.URL)
+	return cache, nil
+}
+
+// sha256File returns the sha256 sum of the content of the file.
+func sha256File(path string) ([]byte, error) {
+	f, err := system.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// openExternal opens a http(s) or file URL, or a local path.
+func openExternal(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		resp, err := system.HTTPGet(ctx, rawURL)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		return resp.Body, nil
+	case "file":
+		return system.Open(u.Path)
+	case "":
+		return system.Open(rawURL)
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+}
+
+// externalDestination returns the destination path of e.
+func (a *App) externalDestination(e config.External) string {
+	if filepath.IsAbs(e.Destination) {
+		return e.Destination
+	}
+	return filepath.Join(a.config.Destination, e.Destination)
+}
+
+// applyExternalFile streams the cached file of e to its destination if it differs, and records it in the store.
+// The destination is skipped if it has been modified since the last apply, unless overwrite is true.
+func (a *App) applyExternalFile(cache string, e config.External, overwrite bool) error {
+	dst := a.externalDestination(e)
+	ds, err := entryCache.GetSum(dst)
+	if err != nil {
+		return err
+	}
+	cs, err := entryCache.GetSum(cache)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(cs, ds) {
+		return nil
+	}
+
+	if modified, err := a.modified(dst); err != nil {
+		return err
+	} else if modified && !overwrite {
+		fmt.Fprintf(a.out, "Skipped: %s has been modified since the last apply. use --overwrite to overwrite\n", dst)
+		return nil
+	}
+
+	if err := system.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	de, err := copyFile(cache, dst, externalMode(e, 0))
+	if err != nil {
+		return err
+	}
+	if err := a.recordEntry(de); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Applied: %s from %s\n", dst, e.URL)
+	return nil
+}
+
+// extractExternal extracts the members of the archive into the destination directory of e.
+// The format is detected from the extension of the URL.
+func (a *App) extractExternal(cache string, e config.External, overwrite bool) error {
+	dir := a.externalDestination(e)
+	if err := system.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	extract := func(name string, mode fs.FileMode, r io.Reader) error {
+		name = stripComponents(name, e.StripComponents)
+		if name == "" || !mode.IsRegular() {
+			return nil
+		}
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("%s: invalid path in archive", name)
+		}
+		dst := filepath.Join(dir, name)
+		if err := system.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return err
+		}
+		return a.applyFrom(dst, r, externalMode(e, mode), e.URL, overwrite)
+	}
+
+	switch name := strings.ToLower(e.URL); {
+	case strings.HasSuffix(name, ".zip"):
+		zr, err := zip.OpenReader(cache)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if err := func() error {
+				r, err := f.Open()
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				return extract(f.Name, f.Mode(), r)
+			}(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"), strings.HasSuffix(name, ".tar"):
+		f, err := system.Open(cache)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var r io.Reader = f
+		if !strings.HasSuffix(name, ".tar") {
+			gr, err := gzip.NewReader(f)
+			if err != nil {
+				return err
+			}
+			defer gr.Close()
+			r = gr
+		}
+		tr := tar.NewReader(r)
+		for {
+			h, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := extract(h.Name, h.FileInfo().Mode(), tr); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("unsupported archive format")
+	}
+}
+
+// applyFrom streams the content read from r to dst if it differs, and records it in the store.
+// The destination is skipped if it has been modified since the last apply, unless overwrite is true.
+// As the content is compared while it is written, the pending file is discarded in both cases.
+func (a *App) applyFrom(dst string, r io.Reader, perm fs.FileMode, from string, overwrite bool) error {
+	de, err := entryCache.Get(dst)
+	if err != nil {
+		return err
+	}
+	ds, err := de.GetSum()
+	if err != nil {
+		return err
+	}
+	modified, err := a.modified(dst)
+	if err != nil {
+		return err
+	}
+	h, err := newHash(de.algorithm())
+	if err != nil {
+		return err
+	}
+
+	var skipped bool
+	check := func() error {
+		if bytes.Equal(h.Sum(nil), ds) {
+			return errNotWritten
+		}
+		if modified && !overwrite {
+			skipped = true
+			return errNotWritten
+		}
+		return nil
+	}
+	if err := system.OverwriteFrom(dst, io.TeeReader(r, h), perm, check); errors.Is(err, errNotWritten) {
+		if skipped {
+			fmt.Fprintf(a.out, "Skipped: %s has been modified since the last apply. use --overwrite to overwrite\n", dst)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := a.record(dst); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Applied: %s from %s\n", dst, from)
+	return nil
+}
+
+// externalMode returns the configured permission of e, or the permission of the archive member,
+// or the default one.
+func externalMode(e config.External, member fs.FileMode) fs.FileMode {
+	switch {
+	case e.Mode != 0:
+		return e.Mode.Perm()
+	case member.Perm() != 0:
+		return member.Perm()
+	default:
+		return defaultExternalMode
+	}
+}
+
+// stripComponents removes the first n elements from the slash separated name.
+func stripComponents(name string, n int) string {
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	if n >= len(parts) {
+		return ""
+	}
+	return filepath.FromSlash(strings.Join(parts[n:], "/"))
+}
@@ -0,0 +1,42 @@
+package donut
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"github.com/nishikirb/donut/config"
+	"github.com/nishikirb/donut/xxhash"
+)
+
+// hashes are the algorithms of the sums of the entries by their names, selected by the hash setting.
+var hashes = map[string]func() hash.Hash{
+	config.HashSHA256: sha256.New,
+	config.HashSHA512: sha512.New,
+	config.HashMD5:    md5.New,
+	config.HashXXH64:  func() hash.Hash { return xxhash.New() },
+}
+
+// newHash returns a new hash of the algorithm, which is sha256 if empty.
+func newHash(algorithm string) (hash.Hash, error) {
+	if algorithm == "" {
+		algorithm = config.HashSHA256
+	}
+	h, ok := hashes[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+	return h(), nil
+}
+
+// sumOf returns the sum of data computed with the algorithm.
+func sumOf(algorithm string, data []byte) ([]byte, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(data)
+	return h.Sum(nil), nil
+}
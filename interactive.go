@@ -0,0 +1,116 @@
+package donut
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errQuit is returned when the user quits the interactive apply.
+var errQuit = errors.New("quit")
+
+// inlineDiffLines is the maximum number of lines of the diff shown before each prompt.
+const inlineDiffLines = 10
+
+const applyPromptHelp = `y - apply this file
+n - skip this file
+d - show the full diff
+m - merge this file with the merge tool
+a - apply this file and all the remaining files
+q - quit, skipping this file and all the remaining files
+`
+
+// applyInteractive asks whether to apply each change, one at a time in the order of changes.
+func (a *App) applyInteractive(ctx context.Context, changes []PathMapping, overwrite bool) error {
+	for i, pm := range changes {
+		modified, err := a.modified(pm.Destination)
+		if err != nil {
+			return err
+		}
+		if err := a.inlineDiff(pm); err != nil {
+			return err
+		}
+
+		note := ""
+		if modified {
+			note = " (modified since the last apply)"
+		}
+
+	prompt:
+		for {
+			answer, err := a.ask("Apply %s%s [y,n,d,m,a,q,?]? ", pm.Destination, note)
+			if errors.Is(err, io.EOF) {
+				return errQuit
+			} else if err != nil {
+				return err
+			}
+
+			switch answer {
+			case "y", "yes":
+				// the answer overrides the modification check for this file
+				if err := a.applyFile(pm, true); err != nil {
+					return err
+				}
+				break prompt
+			case "", "n", "no":
+				fmt.Fprintf(a.out, "Skipped: %s\n", pm.Destination)
+				break prompt
+			case "d", "diff":
+				out, err := a.diffFile(ctx, pm)
+				if err != nil {
+					return err
+				}
+				if _, err := a.out.Write(out); err != nil {
+					return err
+				}
+			case "m", "merge":
+				if err := a.mergeFile(ctx, pm); err != nil {
+					return err
+				}
+				break prompt
+			case "a", "all":
+				if err := a.applyFile(pm, true); err != nil {
+					return err
+				}
+				for _, rest := range changes[i+1:] {
+					if err := a.applyFile(rest, overwrite); err != nil {
+						return err
+					}
+				}
+				return nil
+			case "q", "quit":
+				return errQuit
+			default:
+				fmt.Fprint(a.out, applyPromptHelp)
+			}
+		}
+	}
+	return nil
+}
+
+// inlineDiff writes the beginning of the built-in diff of pm to out.
+func (a *App) inlineDiff(pm PathMapping) error {
+	var out []byte
+	var err error
+	if pm.Dir {
+		out, err = dirDiff(pm)
+	} else {
+		out, err = a.builtinDiff(pm, 1)
+	}
+	if err != nil {
+		return err
+	}
+
+	lines := bytes.SplitAfter(out, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > inlineDiffLines {
+		rest := len(lines) - inlineDiffLines
+		lines = append(lines[:inlineDiffLines], []byte(fmt.Sprintf("... %d more lines, press d to show the full diff\n", rest)))
+	}
+	_, err = a.out.Write(bytes.Join(lines, nil))
+	return err
+}
@@ -0,0 +1,208 @@
+package donut
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/nishikirb/donut/system"
+)
+
+// mergePair is a changed mapping copied into the temporary tree of a batch merge.
+type mergePair struct {
+	PathMapping
+	tmpSource      string
+	tmpDestination string
+	source         []byte
+	destination    []byte
+}
+
+// mergeFile runs the merge tool for a single mapping. After the tool exits successfully,
+// the destination is recorded as the last applied state, and if it still differs from
+// the source, the user is asked whether to write it back into the source.
+func (a *App) mergeFile(ctx context.Context, pm PathMapping) error {
+	args, err := executeTemplate("merge", newTemplateParams(pm))
+	if err != nil {
+		return err
+	}
+	// the merge tool needs the directory to save a destination that does not exist yet
+	if err := system.MkdirAll(filepath.Dir(pm.Destination), os.ModePerm); err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, a.config.Merge[0], args...)
+	cmd.Stdin = a.in
+	cmd.Stdout = unwrap(a.out)
+	if err := system.Run(cmd); err != nil {
+		return err
+	}
+
+	// the merge tool may have edited both sides
+	se, err := entryCache.Reload(pm.Source)
+	if err != nil {
+		return err
+	}
+	ss, err := se.GetSum()
+	if err != nil {
+		return err
+	}
+	if err := a.record(pm.Destination); err != nil {
+		return err
+	}
+	ds, err := entryCache.GetSum(pm.Destination)
+	if err != nil {
+		return err
+	}
+	if ds == nil || bytes.Equal(ss, ds) {
+		return nil
+	}
+
+	if ok, err := a.confirm("Write the merged %s back to %s?", pm.Destination, pm.Source); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+	dc, err := readEntry(pm.Destination)
+	if err != nil {
+		return err
+	}
+	if err := system.Overwrite(pm.Source, dc, se.Mode.Perm()); err != nil {
+		return err
+	}
+	if _, err := entryCache.Reload(pm.Source); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Updated: %s\n", pm.Source)
+	return nil
+}
+
+// mergeBatch copies every changed mapping into a temporary directory tree and runs
+// a single directory merge session on it. Files edited in the session are copied back.
+// The batch command is configured by merge_batch and falls back to merge.
+func (a *App) mergeBatch(ctx context.Context, changes []PathMapping) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	tmp, err := system.MkdirTemp("", "donut-merge-")
+	if err != nil {
+		return err
+	}
+	defer system.RemoveAll(tmp)
+
+	params := templateParams{
+		Source:      filepath.Join(tmp, "source"),
+		Destination: filepath.Join(tmp, "destination"),
+	}
+	pairs := make([]mergePair, 0, len(changes))
+	for _, pm := range changes {
+		rel, err := filepath.Rel(a.config.Source, pm.Source)
+		if err != nil {
+			return err
+		}
+		p := mergePair{
+			PathMapping:    pm,
+			tmpSource:      filepath.Join(params.Source, rel),
+			tmpDestination: filepath.Join(params.Destination, rel),
+		}
+		if p.source, err = readEntry(pm.Source); err != nil {
+			return err
+		}
+		if p.destination, err = readEntry(pm.Destination); err != nil {
+			return err
+		}
+		if err := writeTemp(p.tmpSource, p.source); err != nil {
+			return err
+		}
+		// a missing destination is left out so that the merge tool shows it as new
+		if p.destination != nil {
+			if err := writeTemp(p.tmpDestination, p.destination); err != nil {
+				return err
+			}
+		}
+		pairs = append(pairs, p)
+	}
+
+	name, cmdName := "merge", a.config.Merge[0]
+	if len(a.config.MergeBatch) > 0 {
+		name, cmdName = "merge_batch", a.config.MergeBatch[0]
+	}
+	args, err := executeTemplate(name, params)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, cmdName, args...)
+	cmd.Stdin = a.in
+	cmd.Stdout = unwrap(a.out)
+	if err := system.Run(cmd); err != nil {
+		return err
+	}
+
+	for _, p := range pairs {
+		if updated, err := copyBack(p.tmpDestination, p.Destination, p.destination); err != nil {
+			return err
+		} else if updated {
+			if err := a.record(p.Destination); err != nil {
+				return err
+			}
+			fmt.Fprintf(a.out, "Merged: %s\n", p.Destination)
+		}
+		if updated, err := copyBack(p.tmpSource, p.Source, p.source); err != nil {
+			return err
+		} else if updated {
+			if _, err := entryCache.Reload(p.Source); err != nil {
+				return err
+			}
+			fmt.Fprintf(a.out, "Updated: %s\n", p.Source)
+		}
+	}
+	return nil
+}
+
+// readEntry returns the content of path, or nil if it does not exist.
+func readEntry(path string) ([]byte, error) {
+	e, err := entryCache.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	return e.GetContent()
+}
+
+func writeTemp(path string, data []byte) error {
+	if err := system.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return system.Overwrite(path, data, 0600)
+}
+
+// copyBack writes the content of the temporary file tmp to path if it was changed
+// from the original content. It reports whether path was updated.
+func copyBack(tmp, path string, original []byte) (bool, error) {
+	data, err := system.ReadFile(tmp)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if original != nil && bytes.Equal(data, original) {
+		return false, nil
+	}
+
+	perm := os.ModePerm
+	if e, err := entryCache.Get(path); err != nil {
+		return false, err
+	} else if !e.Empty {
+		perm = e.Mode.Perm()
+	}
+	if err := system.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return false, err
+	}
+	if err := system.Overwrite(path, data, perm); err != nil {
+		return false, err
+	}
+	return true, nil
+}
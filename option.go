@@ -4,6 +4,7 @@ import (
 	"io"
 
 	"github.com/nishikirb/donut/config"
+	"github.com/nishikirb/donut/store"
 )
 
 type Option func(*App) error
@@ -26,6 +27,46 @@ func WithConfigLoader(opts ...config.ConfigOption) Option {
 	}
 }
 
+// WithStore sets the store of the last applied states. The default store is used if not set.
+func WithStore(s store.Store) Option {
+	return func(a *App) error {
+		a.store = s
+		return nil
+	}
+}
+
+// WithStateFile sets the file of the store opened on each run, instead of the file of the config.
+func WithStateFile(file string) Option {
+	return func(a *App) error {
+		a.stateFile = file
+		return nil
+	}
+}
+
+// WithStoreOptions sets the options to open the store on each run.
+func WithStoreOptions(opts ...store.Option) Option {
+	return func(a *App) error {
+		a.storeOpts = append(a.storeOpts, opts...)
+		return nil
+	}
+}
+
+// WithWait makes the run wait for the lock of the store held by another process, instead of failing.
+func WithWait() Option {
+	return func(a *App) error {
+		a.wait = true
+		return nil
+	}
+}
+
+// WithRehash makes the run hash all the files, instead of reusing the sums of the unchanged files.
+func WithRehash() Option {
+	return func(a *App) error {
+		a.rehash = true
+		return nil
+	}
+}
+
 func WithIn(r io.Reader) Option {
 	return func(a *App) error {
 		a.in = r
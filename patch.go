@@ -0,0 +1,244 @@
+package donut
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/nishikirb/donut/config"
+)
+
+// Patch is the part of a structured document of the destination file that has the keys of the source document.
+// The source is deep-merged into the destination: tables are merged key by key, and other values,
+// including arrays, are replaced. The documents are rewritten with sorted keys, and comments are not kept.
+// JSON documents may have comments and trailing commas, which are dropped as well.
+type Patch struct {
+	Format string
+	// Source is the path of the source document, whose keys are the managed ones.
+	Source string
+}
+
+// NewPatch returns the patch of the source document. The format is detected from the extension if empty.
+func NewPatch(format, source string) *Patch {
+	if format == "" {
+		format = patchFormat(source)
+	}
+	return &Patch{
+		Format: format,
+		Source: source,
+	}
+}
+
+// Extract returns the destination document with only the keys of the source document.
+// It reports false if either of the documents cannot be parsed.
+func (p *Patch) Extract(content []byte) ([]byte, bool) {
+	sc, err := readEntry(p.Source)
+	if err != nil {
+		return nil, false
+	}
+	src, err := p.decode(sc)
+	if err != nil {
+		return nil, false
+	}
+	dst, err := p.decode(content)
+	if err != nil {
+		return nil, false
+	}
+	out, err := p.encode(projectDocument(dst, src))
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+// Replace returns the destination document with the source document merged into it.
+func (p *Patch) Replace(content, source []byte) ([]byte, error) {
+	src, err := p.decode(source)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Source, err)
+	}
+	dst, err := p.decode(content)
+	if err != nil {
+		return nil, err
+	}
+	return p.encode(mergeDocument(dst, src))
+}
+
+// Normalize returns the source document in the same formatting as the destination one.
+func (p *Patch) Normalize(source []byte) ([]byte, error) {
+	src, err := p.decode(source)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Source, err)
+	}
+	return p.encode(src)
+}
+
+func (p *Patch) decode(content []byte) (map[string]any, error) {
+	doc := map[string]any{}
+	if len(bytes.TrimSpace(content)) == 0 {
+		return doc, nil
+	}
+	var err error
+	switch p.Format {
+	case config.PatchFormatJSON:
+		// JSON with comments and trailing commas, such as the settings of VS Code, is read as well
+		d := json.NewDecoder(bytes.NewReader(stripJSONC(content)))
+		// numbers are kept as written, instead of being rounded to float64
+		d.UseNumber()
+		err = d.Decode(&doc)
+	case config.PatchFormatTOML:
+		err = toml.Unmarshal(content, &doc)
+	case config.PatchFormatYAML:
+		err = yaml.Unmarshal(content, &doc)
+	default:
+		return nil, fmt.Errorf("unknown patch format %q", p.Format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s document: %w", p.Format, err)
+	}
+	return doc, nil
+}
+
+func (p *Patch) encode(doc map[string]any) ([]byte, error) {
+	var buf bytes.Buffer
+	switch p.Format {
+	case config.PatchFormatJSON:
+		e := json.NewEncoder(&buf)
+		e.SetEscapeHTML(false)
+		e.SetIndent("", "  ")
+		if err := e.Encode(doc); err != nil {
+			return nil, err
+		}
+	case config.PatchFormatTOML:
+		if err := toml.NewEncoder(&buf).Encode(doc); err != nil {
+			return nil, err
+		}
+	case config.PatchFormatYAML:
+		e := yaml.NewEncoder(&buf)
+		e.SetIndent(2)
+		if err := e.Encode(doc); err != nil {
+			return nil, err
+		}
+		if err := e.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown patch format %q", p.Format)
+	}
+	return buf.Bytes(), nil
+}
+
+// stripJSONC removes the comments and the trailing commas of JSON with comments, leaving the strings untouched.
+// The line breaks are kept, so that the errors report the lines of content.
+func stripJSONC(content []byte) []byte {
+	// the comments are removed first, as one may be between a trailing comma and the closing bracket
+	out := make([]byte, 0, len(content))
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; {
+		case c == '"':
+			end := stringEnd(content, i)
+			out = append(out, content[i:end]...)
+			i = end - 1
+		case c == '/' && i+1 < len(content) && content[i+1] == '/':
+			for i < len(content) && content[i] != '\n' {
+				i++
+			}
+			if i < len(content) {
+				out = append(out, '\n')
+			}
+		case c == '/' && i+1 < len(content) && content[i+1] == '*':
+			for i += 2; i < len(content) && !(content[i] == '*' && i+1 < len(content) && content[i+1] == '/'); i++ {
+				if content[i] == '\n' {
+					out = append(out, '\n')
+				}
+			}
+			i++
+		default:
+			out = append(out, c)
+		}
+	}
+
+	stripped := make([]byte, 0, len(out))
+	for i := 0; i < len(out); i++ {
+		switch c := out[i]; c {
+		case '"':
+			end := stringEnd(out, i)
+			stripped = append(stripped, out[i:end]...)
+			i = end - 1
+		case ',':
+			next := bytes.TrimLeft(out[i+1:], " \t\r\n")
+			if len(next) > 0 && (next[0] == '}' || next[0] == ']') {
+				continue
+			}
+			stripped = append(stripped, c)
+		default:
+			stripped = append(stripped, c)
+		}
+	}
+	return stripped
+}
+
+// stringEnd returns the index just after the JSON string starting at the quote at start,
+// or the length of content if the string is not closed.
+func stringEnd(content []byte, start int) int {
+	for i := start + 1; i < len(content); i++ {
+		switch content[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(content)
+}
+
+// patchFormat returns the format of the document detected from the extension of path.
+func patchFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return config.PatchFormatJSON
+	case ".toml":
+		return config.PatchFormatTOML
+	case ".yaml", ".yml":
+		return config.PatchFormatYAML
+	}
+	return ""
+}
+
+// mergeDocument merges src into dst recursively, and returns dst.
+func mergeDocument(dst, src map[string]any) map[string]any {
+	for k, v := range src {
+		sm, ok := v.(map[string]any)
+		dm, dok := dst[k].(map[string]any)
+		if ok && dok {
+			dst[k] = mergeDocument(dm, sm)
+			continue
+		}
+		dst[k] = v
+	}
+	return dst
+}
+
+// projectDocument returns the values of dst whose keys are in src, recursively into the tables of both.
+func projectDocument(dst, src map[string]any) map[string]any {
+	out := make(map[string]any, len(src))
+	for k, v := range src {
+		dv, ok := dst[k]
+		if !ok {
+			continue
+		}
+		sm, ok := v.(map[string]any)
+		dm, dok := dv.(map[string]any)
+		if ok && dok {
+			out[k] = projectDocument(dm, sm)
+			continue
+		}
+		out[k] = dv
+	}
+	return out
+}
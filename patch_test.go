@@ -0,0 +1,97 @@
+package donut
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nishikirb/donut/test/helper"
+)
+
+func TestPatch_Replace(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		content   string
+		source    string
+		want      string
+		extracted string
+		assertion assert.ErrorAssertionFunc
+	}{
+		{
+			name:      "OK/JSON",
+			file:      "settings.json",
+			content:   `{"a": 1, "b": {"c": [1, 2], "d": "keep"}, "e": 10000000000000001}`,
+			source:    `{"b": {"c": [3]}, "f": true}`,
+			want:      "{\n  \"a\": 1,\n  \"b\": {\n    \"c\": [\n      3\n    ],\n    \"d\": \"keep\"\n  },\n  \"e\": 10000000000000001,\n  \"f\": true\n}\n",
+			extracted: "{\n  \"b\": {\n    \"c\": [\n      3\n    ]\n  },\n  \"f\": true\n}\n",
+			assertion: assert.NoError,
+		},
+		{
+			name: "OK/JSONC",
+			file: "settings.json",
+			content: "// VS Code settings\n{\n  /* the font */\n  \"editor.fontSize\": 14, // px\n" +
+				"  \"files.exclude\": {\"**/.git\": true,},\n  \"url\": \"https://example.com/*\",\n}\n",
+			source:    `{"editor.fontSize": 16}`,
+			want:      "{\n  \"editor.fontSize\": 16,\n  \"files.exclude\": {\n    \"**/.git\": true\n  },\n  \"url\": \"https://example.com/*\"\n}\n",
+			extracted: "{\n  \"editor.fontSize\": 16\n}\n",
+			assertion: assert.NoError,
+		},
+		{
+			name:      "OK/TOML",
+			file:      "config.toml",
+			content:   "a = 1\n\n[b]\nd = 'keep'\n",
+			source:    "[b]\nc = 'new'\n",
+			want:      "a = 1\n\n[b]\nc = 'new'\nd = 'keep'\n",
+			extracted: "[b]\nc = 'new'\n",
+			assertion: assert.NoError,
+		},
+		{
+			name:      "OK/YAML",
+			file:      "config.yml",
+			content:   "a: 1\nb:\n  d: keep\n",
+			source:    "b:\n  c: new\n",
+			want:      "a: 1\nb:\n  c: new\n  d: keep\n",
+			extracted: "b:\n  c: new\n",
+			assertion: assert.NoError,
+		},
+		{
+			name:      "OK/Empty",
+			file:      "settings.json",
+			content:   "",
+			source:    `{"a": 1}`,
+			want:      "{\n  \"a\": 1\n}\n",
+			extracted: "{\n  \"a\": 1\n}\n",
+			assertion: assert.NoError,
+		},
+		{
+			name:      "Error/Invalid",
+			file:      "settings.json",
+			content:   `{"a": `,
+			source:    `{"a": 1}`,
+			assertion: assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entryCache = &EntryCache{}
+			source := filepath.Join(t.TempDir(), tt.file)
+			helper.WriteFile(t, source, []byte(tt.source), 0644)
+			p := NewPatch("", source)
+
+			got, err := p.Replace([]byte(tt.content), []byte(tt.source))
+			tt.assertion(t, err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tt.want, string(got))
+			extracted, ok := p.Extract(got)
+			assert.True(t, ok)
+			assert.Equal(t, tt.extracted, string(extracted))
+			normalized, err := p.Normalize([]byte(tt.source))
+			assert.NoError(t, err)
+			assert.Equal(t, extracted, normalized)
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package donut
 
 import (
+	"errors"
+	"fmt"
 	"io/fs"
 	"path/filepath"
 	"slices"
 	"strings"
+
+	"github.com/nishikirb/donut/system"
 )
 
 type PathMapper struct {
@@ -12,16 +16,48 @@ type PathMapper struct {
 	source      string
 	destination string
 	excludes    []string
+	modes       map[string]fs.FileMode
+	exacts      []string
+	blocks      map[string]*Block
+	patches     map[string]string
 }
 
 type PathMapping struct {
 	Source      string
 	Destination string
+	// Dir is true if the source is a directory.
+	Dir bool
+	// Mode is the permission of the destination directory.
+	Mode fs.FileMode
+	// ModeSet is true if Mode is set by the modes config. Otherwise Mode is the permission of the source
+	// directory, which is only used to create the destination, as git does not preserve it.
+	ModeSet bool
+	// Exact is true if the unmanaged children of the destination directory are removed on apply.
+	Exact bool
+	// View is the part of the destination file managed by donut. The whole file is managed if nil.
+	View View
+	// Remove is true if the destination must not exist. The source is the marker file or the remove list.
+	Remove bool
+	// RemoveDir is true if the removal is declared for a directory, which is removed with its contents.
+	// A non-empty directory is otherwise kept.
+	RemoveDir bool
 }
 
 type PathMapperOption func(m *PathMapper)
 
-var defaultExcludes = []string{".git"}
+var defaultExcludes = []string{".git", removeListName}
+
+// exactPrefix is the prefix of a source directory name that marks the directory as exact.
+// The prefix is removed from the destination path.
+const exactPrefix = "exact_"
+
+// removePrefix is the prefix of a source file name that marks the destination to be removed.
+// The prefix is removed from the destination path, and the content of the marker file is ignored.
+const removePrefix = "remove_"
+
+// removeListName is the name of the file in the source directory listing the destinations to be removed,
+// one path relative to the destination directory per line. Empty lines and lines starting with # are ignored.
+const removeListName = ".donutremove"
 
 func NewPathMapper(s, d string, funcs ...PathMapperOption) (*PathMapper, error) {
 	m := &PathMapper{
@@ -36,27 +72,44 @@ func NewPathMapper(s, d string, funcs ...PathMapperOption) (*PathMapper, error)
 
 	err := filepath.WalkDir(m.source, func(path string, d fs.DirEntry, _ error) error {
 		rel, _ := filepath.Rel(m.source, path)
-		eq := func(s string) bool {
-			ok, _ := filepath.Match(s, rel)
-			return ok
-		}
 		if d.IsDir() {
-			if slices.ContainsFunc(m.excludes, eq) {
+			if m.Excluded(rel) {
 				return fs.SkipDir
 			}
+			// the source directory itself is not an entry
+			if rel == "." {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			dRel, exact := destinationRel(rel, true)
+			mode, set := m.mode(rel, info.Mode().Perm())
+			m.addDirMapping(path, filepath.Join(m.destination, dRel), mode, set, exact || m.exact(rel))
 			return nil
 		}
-		if slices.ContainsFunc(m.excludes, eq) {
+		if m.Excluded(rel) {
 			return nil
 		}
 
 		// Specify the destination path
-		dPath := strings.Replace(path, m.source, m.destination, 1)
-		m.addMapping(path, dPath)
+		dRel, _ := destinationRel(rel, false)
+		if dRel, ok := removeRel(dRel); ok {
+			m.addRemoveMapping(path, filepath.Join(m.destination, dRel), false)
+			return nil
+		}
+		m.addMapping(path, filepath.Join(m.destination, dRel), m.view(rel, path))
 		return nil
 	})
+	if err != nil {
+		return m, err
+	}
 
-	return m, err
+	if err := m.readRemoveList(); err != nil {
+		return m, err
+	}
+	return m, m.checkRemovals()
 }
 
 func WithExcludes(s ...string) PathMapperOption {
@@ -65,18 +118,245 @@ func WithExcludes(s ...string) PathMapperOption {
 	}
 }
 
+// WithModes sets the permissions of the directories matching the patterns,
+// which take precedence over the permissions of the source directories.
+func WithModes(modes map[string]fs.FileMode) PathMapperOption {
+	return func(m *PathMapper) {
+		m.modes = modes
+	}
+}
+
+// WithExact marks the directories matching the patterns as exact.
+func WithExact(s ...string) PathMapperOption {
+	return func(m *PathMapper) {
+		m.exacts = append(m.exacts, s...)
+	}
+}
+
+// WithBlocks makes the files matching the patterns manage only the block of the destination.
+func WithBlocks(blocks map[string]*Block) PathMapperOption {
+	return func(m *PathMapper) {
+		m.blocks = blocks
+	}
+}
+
+// WithPatches makes the files matching the patterns patch the structured documents of the destination.
+// The values are the formats of the documents, which are detected from the extensions if empty.
+func WithPatches(patches map[string]string) PathMapperOption {
+	return func(m *PathMapper) {
+		m.patches = patches
+	}
+}
+
+// RelSourcePaths returns the source paths relative to the source directory, except for the removals.
+// Directories have a trailing separator.
 func (m *PathMapper) RelSourcePaths() []string {
 	var paths []string
 	for _, v := range m.Mapping {
+		if v.Remove {
+			continue
+		}
 		rel, _ := filepath.Rel(m.source, v.Source)
+		if v.Dir {
+			rel += string(filepath.Separator)
+		}
 		paths = append(paths, rel)
 	}
 	return paths
 }
 
-func (m *PathMapper) addMapping(src, dst string) {
+// Excluded reports whether the path relative to the source directory matches any of the excludes.
+func (m *PathMapper) Excluded(rel string) bool {
+	return slices.ContainsFunc(m.excludes, func(s string) bool {
+		ok, _ := filepath.Match(s, rel)
+		return ok
+	})
+}
+
+// Unmanaged returns the paths in the exact destination directories that are neither mapped nor excluded.
+// Only the direct children are checked, and the unmanaged directories are returned without their contents.
+// The excludes are matched with the paths the children would have in the source directory, as in the source walk,
+// e.g. "exact_lua/local.lua" for "lua/local.lua" of the destination.
+func (m *PathMapper) Unmanaged() ([]string, error) {
+	managed := make(map[string]bool, len(m.Mapping))
+	for _, pm := range m.Mapping {
+		managed[pm.Destination] = true
+	}
+
+	var paths []string
+	for _, pm := range m.Mapping {
+		if !pm.Exact {
+			continue
+		}
+		err := filepath.WalkDir(pm.Destination, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// the directory is created on apply
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if path == pm.Destination {
+				return nil
+			}
+			rel, _ := filepath.Rel(pm.Destination, path)
+			dir, _ := filepath.Rel(m.source, pm.Source)
+			if m.Excluded(filepath.Join(dir, rel)) || managed[path] {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			paths = append(paths, path)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// exact reports whether the path relative to the source directory matches any of the exacts.
+func (m *PathMapper) exact(rel string) bool {
+	return slices.ContainsFunc(m.exacts, func(s string) bool {
+		ok, _ := filepath.Match(s, rel)
+		return ok
+	})
+}
+
+// destinationRel removes the exact prefix from the directory names of the relative source path.
+// It reports whether the last element is an exact directory.
+func destinationRel(rel string, dir bool) (string, bool) {
+	exact := false
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, p := range parts {
+		last := i == len(parts)-1
+		if (!last || dir) && strings.HasPrefix(p, exactPrefix) && len(p) > len(exactPrefix) {
+			parts[i] = strings.TrimPrefix(p, exactPrefix)
+			exact = last
+		}
+	}
+	return filepath.Join(parts...), exact
+}
+
+// removeRel removes the remove prefix from the file name of the relative destination path.
+// It reports whether the file is a remove marker.
+func removeRel(rel string) (string, bool) {
+	dir, name := filepath.Split(rel)
+	if !strings.HasPrefix(name, removePrefix) || len(name) == len(removePrefix) {
+		return rel, false
+	}
+	return filepath.Join(dir, strings.TrimPrefix(name, removePrefix)), true
+}
+
+// readRemoveList adds the removals listed in the remove list of the source directory, if it exists.
+// A line ending with a slash removes the directory with its contents.
+func (m *PathMapper) readRemoveList() error {
+	path := filepath.Join(m.source, removeListName)
+	b, err := system.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rel := filepath.Clean(filepath.FromSlash(line))
+		if !filepath.IsLocal(rel) || rel == "." {
+			return fmt.Errorf("%s: %s: not a path in the destination directory", path, line)
+		}
+		// a trailing slash declares the removal of a directory with its contents
+		m.addRemoveMapping(path, filepath.Join(m.destination, rel), strings.HasSuffix(line, "/"))
+	}
+	return nil
+}
+
+// checkRemovals returns an error if a removal would remove the destination directory or a managed path.
+func (m *PathMapper) checkRemovals() error {
+	for _, r := range m.Mapping {
+		if !r.Remove {
+			continue
+		}
+		if r.Destination == m.destination {
+			return fmt.Errorf("%s: the destination directory cannot be removed", r.Source)
+		}
+		for _, pm := range m.Mapping {
+			if !pm.Remove && affected(pm.Destination, []string{r.Destination}) {
+				return fmt.Errorf("%s: %s is managed by %s", r.Source, r.Destination, pm.Source)
+			}
+		}
+	}
+	return nil
+}
+
+// mode returns the permission of the directory from the first matching pattern of modes,
+// or perm if none matches. Patterns are sorted so that the result does not depend on the map order.
+func (m *PathMapper) mode(rel string, perm fs.FileMode) (fs.FileMode, bool) {
+	if p, ok := match(m.modes, rel); ok {
+		return m.modes[p].Perm(), true
+	}
+	return perm, false
+}
+
+// view returns the view of the source file at path, or nil if the whole file is managed.
+// A block takes precedence over a patch.
+func (m *PathMapper) view(rel, path string) View {
+	if p, ok := match(m.blocks, rel); ok {
+		return m.blocks[p]
+	}
+	if p, ok := match(m.patches, rel); ok {
+		return NewPatch(m.patches[p], path)
+	}
+	return nil
+}
+
+// match returns the first pattern of patterns in the sorted order matching rel.
+func match[V any](patterns map[string]V, rel string) (string, bool) {
+	keys := make([]string, 0, len(patterns))
+	for p := range patterns {
+		keys = append(keys, p)
+	}
+	slices.Sort(keys)
+	for _, p := range keys {
+		if ok, _ := filepath.Match(p, rel); ok {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func (m *PathMapper) addMapping(src, dst string, view View) {
+	m.Mapping = append(m.Mapping, PathMapping{
+		Source:      src,
+		Destination: dst,
+		View:        view,
+	})
+}
+
+func (m *PathMapper) addRemoveMapping(src, dst string, dir bool) {
+	m.Mapping = append(m.Mapping, PathMapping{
+		Source:      src,
+		Destination: dst,
+		Remove:      true,
+		RemoveDir:   dir,
+	})
+}
+
+func (m *PathMapper) addDirMapping(src, dst string, mode fs.FileMode, modeSet, exact bool) {
 	m.Mapping = append(m.Mapping, PathMapping{
 		Source:      src,
 		Destination: dst,
+		Dir:         true,
+		Mode:        mode,
+		ModeSet:     modeSet,
+		Exact:       exact,
 	})
 }
@@ -0,0 +1,53 @@
+package donut
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ask writes the question to out and returns the answer line read from in, trimmed and lowercased.
+// io.EOF is returned when the input has ended without an answer.
+func (a *App) ask(format string, args ...any) (string, error) {
+	fmt.Fprintf(a.out, format, args...)
+	line, err := readLine(a.in)
+	if errors.Is(err, io.EOF) && line == "" {
+		fmt.Fprintln(a.out)
+		return "", io.EOF
+	} else if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.ToLower(strings.TrimSpace(line)), nil
+}
+
+// confirm asks a yes/no question, and reports whether the answer was yes.
+// The end of the input is treated as no.
+func (a *App) confirm(format string, args ...any) (bool, error) {
+	answer, err := a.ask(format+" [y/N] ", args...)
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return answer == "y" || answer == "yes", nil
+}
+
+// readLine reads a line from r one byte at a time. The input is not buffered beyond the line,
+// as the rest of it is read by the child processes such as the merge tool.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			line = append(line, b[0])
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
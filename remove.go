@@ -0,0 +1,89 @@
+package donut
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/nishikirb/donut/diff"
+	"github.com/nishikirb/donut/store"
+	"github.com/nishikirb/donut/system"
+)
+
+// removeChanged reports whether the destination of the removal pm still exists.
+func removeChanged(pm PathMapping) (bool, error) {
+	de, err := entryCache.Get(pm.Destination)
+	if err != nil {
+		return false, err
+	}
+	return !de.Empty, nil
+}
+
+// removeDiff describes the removal pm, showing the lines of a destination file as deleted.
+func (a *App) removeDiff(pm PathMapping, context int) ([]byte, error) {
+	de, err := entryCache.Get(pm.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	switch {
+	case de.Empty:
+		return nil, nil
+	case de.Mode.IsDir():
+		fmt.Fprintf(&buf, "directory %s\ndeleted\n", pm.Destination)
+		return buf.Bytes(), nil
+	case !de.Mode.IsRegular():
+		fmt.Fprintf(&buf, "%s\nold type %s\ndeleted\n", pm.Destination, de.Mode.Type())
+		return buf.Bytes(), nil
+	}
+
+	dc, err := de.GetContent()
+	if err != nil {
+		return nil, err
+	}
+	if err := diff.Unified(&buf,
+		diff.File{Name: pm.Destination, Content: dc},
+		diff.File{Name: "/dev/null"},
+		diff.WithContext(context),
+		diff.WithColor(a.config.Color && system.IsTerminal(a.out)),
+	); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// removeDeclared removes the destination of the removal pm. A non-empty directory is kept,
+// unless its removal is declared for a directory with a trailing slash in the remove list.
+func (a *App) removeDeclared(pm PathMapping) error {
+	de, err := entryCache.Get(pm.Destination)
+	if err != nil {
+		return err
+	}
+	if de.Mode.IsDir() && !pm.RemoveDir {
+		children, err := os.ReadDir(pm.Destination)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			fmt.Fprintf(a.out, "Skipped: %s is not empty. list it with a trailing / in %s to remove it with its contents\n", pm.Destination, removeListName)
+			return nil
+		}
+	}
+	return a.remove(pm.Destination)
+}
+
+// remove removes path with its contents, and forgets its last applied state.
+func (a *App) remove(path string) error {
+	if err := system.RemoveAll(path); err != nil {
+		return err
+	}
+	if _, err := entryCache.Reload(path); err != nil {
+		return err
+	}
+	if err := a.storeDelete(store.EntryBucket, path); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Removed: %s\n", path)
+	return nil
+}
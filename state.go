@@ -0,0 +1,331 @@
+package donut
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/nishikirb/donut/config"
+	"github.com/nishikirb/donut/store"
+	"github.com/nishikirb/donut/system"
+)
+
+// migrateState applies the pending migrations of the store, or only displays them with --dry-run.
+func (a *App) migrateState(_ context.Context, _ []string, flags *pflag.FlagSet) error {
+	dryRun, _ := flags.GetBool("dry-run")
+
+	pending, err := store.Pending(a.store)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Fprintf(a.out, "State schema is up to date: version %d\n", store.SchemaVersion)
+		return nil
+	}
+	if dryRun {
+		for _, m := range pending {
+			fmt.Fprintf(a.out, "Pending: version %d: %s\n", m.Version, m.Description)
+		}
+		return nil
+	}
+
+	migrated, err := store.Migrate(a.store)
+	for _, m := range migrated {
+		fmt.Fprintf(a.out, "Migrated: version %d: %s\n", m.Version, m.Description)
+	}
+	return err
+}
+
+// stateDump is the JSON form of the store, the values of each key in each bucket.
+type stateDump map[string]map[string]json.RawMessage
+
+// dumpState prints the values of all the buckets, or of the bucket given with --bucket, as JSON.
+func (a *App) dumpState(_ context.Context, _ []string, flags *pflag.FlagSet) error {
+	bucket, _ := flags.GetString("bucket")
+
+	buckets := store.Buckets()
+	if bucket != "" {
+		buckets = []string{bucket}
+	}
+	dump, err := a.dump(buckets)
+	if err != nil {
+		return err
+	}
+	if bucket != "" {
+		return writeJSON(a.out, dump[bucket])
+	}
+	return writeJSON(a.out, dump)
+}
+
+// getState prints the value of the key as JSON.
+func (a *App) getState(_ context.Context, args []string, flags *pflag.FlagSet) error {
+	bucket, _ := flags.GetString("bucket")
+
+	var raw json.RawMessage
+	if err := a.store.Get(bucket, args[0], &raw); err != nil {
+		return err
+	} else if raw == nil {
+		return fmt.Errorf("%s: not found in %s", args[0], bucket)
+	}
+	return writeJSON(a.out, raw)
+}
+
+// setState replaces the value of the key with the JSON value.
+func (a *App) setState(_ context.Context, args []string, flags *pflag.FlagSet) error {
+	bucket, _ := flags.GetString("bucket")
+
+	if !json.Valid([]byte(args[1])) {
+		return fmt.Errorf("%s: invalid JSON value", args[0])
+	}
+	if err := a.store.Set(bucket, args[0], json.RawMessage(args[1])); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Updated: %s\n", args[0])
+	return nil
+}
+
+// deleteState removes the key.
+func (a *App) deleteState(_ context.Context, args []string, flags *pflag.FlagSet) error {
+	bucket, _ := flags.GetString("bucket")
+
+	if err := a.store.Delete(bucket, args[0]); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Deleted: %s\n", args[0])
+	return nil
+}
+
+// forgetState removes the last applied states of the destination path and the paths under it,
+// so that they are applied as new destinations.
+func (a *App) forgetState(_ context.Context, args []string, _ *pflag.FlagSet) error {
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	keys, err := a.store.Keys(store.EntryBucket)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if !affected(key, []string{path}) {
+			continue
+		}
+		if err := a.storeDelete(store.EntryBucket, key); err != nil {
+			return err
+		}
+		fmt.Fprintf(a.out, "Forgot: %s\n", key)
+	}
+	return nil
+}
+
+// exportState writes all the buckets as JSON to the file, or to stdout if no file is given.
+func (a *App) exportState(_ context.Context, args []string, _ *pflag.FlagSet) error {
+	dump, err := a.dump(store.Buckets())
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || args[0] == "-" {
+		return writeJSON(a.out, dump)
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, dump); err != nil {
+		return err
+	}
+	if err := system.Overwrite(args[0], buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Exported: %s\n", args[0])
+	return nil
+}
+
+// importState sets the values of a file written by export, or of stdin if no file is given.
+// The values of the keys not in the file are kept. The file must have the schema version of the store.
+func (a *App) importState(_ context.Context, args []string, _ *pflag.FlagSet) error {
+	var raw []byte
+	var err error
+	if len(args) == 0 || args[0] == "-" {
+		raw, err = io.ReadAll(a.in)
+	} else {
+		raw, err = system.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	var dump stateDump
+	if err := json.Unmarshal(raw, &dump); err != nil {
+		return fmt.Errorf("invalid state: %w", err)
+	}
+
+	var iv int
+	if raw, ok := dump[store.MetaBucket][store.SchemaVersionKey]; ok {
+		if err := json.Unmarshal(raw, &iv); err != nil {
+			return fmt.Errorf("invalid schema version: %w", err)
+		}
+	}
+	v, err := store.Version(a.store)
+	if err != nil {
+		return err
+	}
+	if iv != v {
+		return fmt.Errorf("the state has schema version %d, but the imported one has %d. migrate the older one first", v, iv)
+	}
+
+	// the values are written at once, so that a failed import records none of them
+	b := store.NewBatch()
+	for bucket, values := range dump {
+		if bucket == store.MetaBucket {
+			continue
+		}
+		for key, value := range values {
+			if err := b.Set(bucket, key, value); err != nil {
+				return fmt.Errorf("%s: %s: %w", bucket, key, err)
+			}
+		}
+	}
+	if err := a.store.Write(b); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Imported: %d values\n", b.Len())
+	return nil
+}
+
+// dump returns the values of the buckets.
+func (a *App) dump(buckets []string) (stateDump, error) {
+	dump := make(stateDump, len(buckets))
+	for _, bucket := range buckets {
+		keys, err := a.store.Keys(bucket)
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]json.RawMessage, len(keys))
+		for _, key := range keys {
+			var raw json.RawMessage
+			if err := a.store.Get(bucket, key, &raw); err != nil {
+				return nil, err
+			}
+			values[key] = raw
+		}
+		dump[bucket] = values
+	}
+	return dump, nil
+}
+
+func writeJSON(w io.Writer, v any) error {
+	e := json.NewEncoder(w)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
+
+// openStore opens the store of the state file for a run. If another process holds the lock,
+// it keeps trying until ctx is done when waiting is enabled, and fails otherwise.
+func (a *App) openStore(ctx context.Context, opts ...store.Option) error {
+	waiting := false
+	for {
+		err := a.adoptLegacyState()
+		if err == nil {
+			var s store.Store
+			if s, err = store.OpenFile(a.statePath(), opts...); err == nil {
+				a.store = s
+				return nil
+			}
+		}
+		var locked *store.LockedError
+		if !a.wait || !errors.As(err, &locked) {
+			return err
+		}
+		if !waiting {
+			fmt.Fprintf(a.err, "Waiting: %s\n", err)
+			waiting = true
+		}
+		// each attempt waits for the lock timeout of the store
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// closeStore closes the store opened by openStore.
+func (a *App) closeStore() error {
+	err := a.store.Close()
+	a.store = nil
+	return err
+}
+
+// statePath returns the state file of the config. It is the file given by WithStateFile or the state setting,
+// donut.db for the config file found in the default directories, and otherwise a file named after
+// the path of the config file, so that configs never share their last applied states.
+func (a *App) statePath() string {
+	switch {
+	case a.stateFile != "":
+		return a.stateFile
+	case a.config == nil:
+		return store.DefaultDBFile()
+	case a.config.State != "":
+		return a.config.State
+	case a.config.File == "" || config.IsDefaultFile(a.config.File):
+		return store.DefaultDBFile()
+	}
+	abs, err := filepath.Abs(a.config.File)
+	if err != nil {
+		abs = a.config.File
+	}
+	sum := sha256.Sum256([]byte(abs))
+	name := strings.TrimSuffix(filepath.Base(abs), filepath.Ext(abs))
+	return filepath.Join(config.DefaultStateDir(), fmt.Sprintf("%s-%s.db", name, hex.EncodeToString(sum[:6])))
+}
+
+// adoptLegacyState moves the state file of the older versions, shared by all the configs, to the state file
+// named after the config, if the config has none yet and no default config file owns the legacy one.
+// Otherwise the destinations applied with the legacy state are not known to be modified, and are
+// overwritten by the next apply. The legacy state is moved, so that no other config starts with it.
+func (a *App) adoptLegacyState() error {
+	path, legacy := a.statePath(), store.DefaultDBFile()
+	if path == legacy || a.stateFile != "" || a.config == nil || a.config.State != "" {
+		return nil
+	}
+	if _, ok := config.FindDefaultFile(); ok {
+		return nil
+	}
+	if _, err := system.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if _, err := system.Stat(legacy); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// the lock keeps the legacy state from being used while it is moved
+	s, err := store.Open(legacy, store.WithManualMigration())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	from, to := blobsOf(legacy), blobsOf(path)
+	if err := os.Rename(from.dir, to.dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// the externals were cached in a directory of their own, as the state was shared
+	if err := os.Rename(filepath.Join(config.DefaultStateDir(), "externals"), a.externalCacheDir()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(legacy, path); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.err, "Moved: %s from %s\n", path, legacy)
+	return nil
+}
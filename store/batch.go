@@ -0,0 +1,60 @@
+package store
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Batch collects changes to be written to a store at once with Write.
+// It is safe for concurrent use.
+type Batch struct {
+	mu  sync.Mutex
+	ops []batchOp
+}
+
+// batchOp is a change of a key. The value is deleted if raw is nil.
+type batchOp struct {
+	bucket string
+	key    string
+	raw    []byte
+}
+
+// NewBatch returns an empty batch.
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Set adds the value of the key. The value is encoded at once, so that a failure is reported for the key.
+func (b *Batch) Set(bucket string, key string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	b.add(batchOp{bucket: bucket, key: key, raw: raw})
+	return nil
+}
+
+// Delete adds the removal of the key.
+func (b *Batch) Delete(bucket string, key string) {
+	b.add(batchOp{bucket: bucket, key: key})
+}
+
+// Len returns the number of changes.
+func (b *Batch) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.ops)
+}
+
+func (b *Batch) add(op batchOp) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ops = append(b.ops, op)
+}
+
+// operations returns the changes in the order they were added.
+func (b *Batch) operations() []batchOp {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]batchOp(nil), b.ops...)
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package store
+
+import (
+	"os"
+)
+
+// flock does nothing, as files cannot be locked on this platform.
+func flock(_ *os.File, _ bool) error {
+	return nil
+}
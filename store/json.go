@@ -0,0 +1,143 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/nishikirb/donut/system"
+)
+
+// JSONStore is a Store implementation that keeps the values in a human readable JSON file.
+// The whole file is rewritten on every change, so it suits small states.
+type JSONStore struct {
+	MemoryStore
+	file     string
+	readOnly bool
+	// lock is the lock file held while the store is open
+	lock *os.File
+	// saveMu serializes the changes with the saves, so that the file never misses a change
+	saveMu sync.Mutex
+}
+
+var _ Store = (*JSONStore)(nil)
+
+// OpenJSON opens the JSON file, which is created on the first change if it does not exist.
+// The file is locked as a bolt database is, with a lock file next to it, and a *LockedError is returned
+// if another process holds the lock. The pending migrations are applied unless WithManualMigration is given.
+func OpenJSON(file string, opts ...Option) (*JSONStore, error) {
+	o := newOptions(opts...)
+	if err := system.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockFile(file, o.readOnly, o.timeout)
+	if err != nil {
+		return nil, err
+	}
+	s := &JSONStore{file: file, readOnly: o.readOnly, lock: lock}
+	if !o.readOnly {
+		if err := writePID(file); err != nil {
+			lock.Close()
+			return nil, err
+		}
+	}
+	if err := s.load(o); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the file, and applies the pending migrations unless they are manual or the store is read-only.
+func (s *JSONStore) load(o *options) error {
+	s.reset()
+	raw, err := system.ReadFile(s.file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	} else if err == nil {
+		var data map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return fmt.Errorf("%s: %w", s.file, err)
+		}
+		for bucket, values := range data {
+			if _, ok := s.data[bucket]; ok && values != nil {
+				s.data[bucket] = values
+			}
+		}
+	}
+
+	if o.migrate && !o.readOnly {
+		if _, err := Migrate(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close releases the lock of the file.
+func (s *JSONStore) Close() error {
+	// the record of the holder is removed while the lock is still held
+	var err error
+	if !s.readOnly {
+		err = removePID(s.file)
+	}
+	return errors.Join(err, s.lock.Close())
+}
+
+// Set stores a value in the store.
+func (s *JSONStore) Set(bucket string, key string, value any) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if err := s.MemoryStore.Set(bucket, key, value); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// Delete removes a value from the store.
+func (s *JSONStore) Delete(bucket string, key string) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if err := s.MemoryStore.Delete(bucket, key); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// Write writes all the changes of the batch, saving the file once.
+func (s *JSONStore) Write(batch *Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if err := s.MemoryStore.Write(batch); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// Clear removes all the values, keeping the buckets.
+func (s *JSONStore) Clear() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if err := s.MemoryStore.Clear(); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *JSONStore) save() error {
+	s.mu.RLock()
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return system.Overwrite(s.file, append(raw, '\n'), 0600)
+}
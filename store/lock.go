@@ -0,0 +1,86 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nishikirb/donut/system"
+)
+
+// LockedError is returned when another process holds the lock of the state file.
+type LockedError struct {
+	File string
+	// PID is the process holding the lock, or 0 if unknown.
+	PID int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("another donut process holds the state lock: %s", e.File)
+	}
+	return fmt.Sprintf("another donut process (pid %d) holds the state lock: %s", e.PID, e.File)
+}
+
+// pidFile returns the file recording the process holding the lock of the state file,
+// since the lock itself does not tell the holder.
+func pidFile(file string) string {
+	return file + ".pid"
+}
+
+// writePID records the current process as the holder of the lock of the state file.
+func writePID(file string) error {
+	return system.Overwrite(pidFile(file), []byte(strconv.Itoa(os.Getpid())+"\n"), 0600)
+}
+
+// removePID removes the record of the holder, written by writePID.
+func removePID(file string) error {
+	if err := system.Remove(pidFile(file)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func lockedError(file string) *LockedError {
+	e := &LockedError{File: file}
+	if raw, err := system.ReadFile(pidFile(file)); err == nil {
+		e.PID, _ = strconv.Atoi(strings.TrimSpace(string(raw)))
+	}
+	return e
+}
+
+// errWouldBlock is returned by flock when another process holds a conflicting lock.
+var errWouldBlock = errors.New("lock would block")
+
+// lockInterval is how often the lock of a state file is tried again while it is held by another process.
+const lockInterval = 50 * time.Millisecond
+
+// lockFile locks the state file that does not lock itself, unlike a bolt database, with a lock file next to it.
+// The lock is shared with the other readers if shared is true, and released by closing the returned file.
+// A *LockedError is returned if another process still holds the lock after the timeout.
+func lockFile(file string, shared bool, timeout time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(file+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := flock(f, shared)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, errWouldBlock) {
+			f.Close()
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, lockedError(file)
+		}
+		time.Sleep(min(lockInterval, time.Until(deadline)))
+	}
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// MemoryStore is a Store implementation that keeps the values in memory, mainly for tests.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string]map[string]json.RawMessage
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore returns an empty MemoryStore of the current schema version.
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{}
+	s.reset()
+	s.data[MetaBucket][SchemaVersionKey] = json.RawMessage(strconv.Itoa(SchemaVersion))
+	return s
+}
+
+// Get retrieves a value from the store.
+func (s *MemoryStore) Get(bucket string, key string, value any) error {
+	s.mu.RLock()
+	b, ok := s.data[bucket]
+	raw := b[key]
+	s.mu.RUnlock()
+	if !ok {
+		return bucketNotFound(bucket)
+	} else if raw == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, value)
+}
+
+// Set stores a value in the store.
+func (s *MemoryStore) Set(bucket string, key string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.data[bucket]
+	if !ok {
+		return bucketNotFound(bucket)
+	}
+	b[key] = raw
+	return nil
+}
+
+// Delete removes a value from the store.
+func (s *MemoryStore) Delete(bucket string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.data[bucket]
+	if !ok {
+		return bucketNotFound(bucket)
+	}
+	delete(b, key)
+	return nil
+}
+
+// Write writes all the changes of the batch, or none of them if a bucket is not found.
+func (s *MemoryStore) Write(batch *Batch) error {
+	ops := batch.operations()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, op := range ops {
+		if _, ok := s.data[op.bucket]; !ok {
+			return bucketNotFound(op.bucket)
+		}
+	}
+	for _, op := range ops {
+		if op.raw == nil {
+			delete(s.data[op.bucket], op.key)
+		} else {
+			s.data[op.bucket][op.key] = op.raw
+		}
+	}
+	return nil
+}
+
+// Keys returns the keys in the bucket.
+func (s *MemoryStore) Keys(bucket string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.data[bucket]
+	if !ok {
+		return nil, bucketNotFound(bucket)
+	}
+	var keys []string
+	for k := range b {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// Clear removes all the values, keeping the buckets.
+func (s *MemoryStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for bucket := range s.data {
+		if bucket != MetaBucket {
+			s.data[bucket] = map[string]json.RawMessage{}
+		}
+	}
+	return nil
+}
+
+// Close does nothing.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) reset() {
+	s.data = make(map[string]map[string]json.RawMessage, len(buckets))
+	for _, bucket := range buckets {
+		s.data[bucket] = map[string]json.RawMessage{}
+	}
+}
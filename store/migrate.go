@@ -0,0 +1,124 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SchemaVersion is the version of the layout of the stored values supported by this build.
+// Stores without a version are version 0, the layout before versioning.
+const SchemaVersion = 4
+
+// SchemaVersionKey is the key of the schema version in the meta bucket.
+const SchemaVersionKey = "schema_version"
+
+// Migration upgrades the stored values from the previous schema version to Version.
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(s Store) error
+}
+
+// migrations are the upgrades of the schema, one version at a time in ascending order.
+// A new migration is appended with SchemaVersion bumped whenever the layout of a stored value changes.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "record the schema version in the meta bucket",
+		Migrate:     func(Store) error { return nil },
+	},
+	{
+		Version:     2,
+		Description: "count the references of the blobs of the applied contents",
+		// the entries recorded before have no blobs, and the bucket is created on open
+		Migrate: func(Store) error { return nil },
+	},
+	{
+		Version:     3,
+		Description: "record the hash algorithm next to the sums of the entries",
+		Migrate:     recordHash,
+	},
+	{
+		Version:     4,
+		Description: "drop the reference counts of the blobs, which gc finds from the entries",
+		Migrate:     dropBlobCounts,
+	},
+}
+
+// Version returns the schema version of the stored values.
+func Version(s Store) (int, error) {
+	var v int
+	if err := s.Get(MetaBucket, SchemaVersionKey, &v); err != nil {
+		return 0, err
+	}
+	return v, nil
+}
+
+// Pending returns the migrations not applied to the store yet.
+// It fails if the store was written by a newer version of donut.
+func Pending(s Store) ([]Migration, error) {
+	v, err := Version(s)
+	if err != nil {
+		return nil, err
+	}
+	if v > SchemaVersion {
+		return nil, fmt.Errorf("state schema version %d is newer than the supported version %d. upgrade donut", v, SchemaVersion)
+	}
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > v {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order, and returns the applied ones.
+// The version is recorded after each migration, so that an interrupted run resumes where it stopped.
+func Migrate(s Store) ([]Migration, error) {
+	pending, err := Pending(s)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range pending {
+		if err := m.Migrate(s); err != nil {
+			return pending[:i], fmt.Errorf("migration to version %d: %w", m.Version, err)
+		}
+		if err := s.Set(MetaBucket, SchemaVersionKey, m.Version); err != nil {
+			return pending[:i], err
+		}
+	}
+	return pending, nil
+}
+
+// recordHash records sha256, the only algorithm before, as the algorithm of the sums of the entries.
+func recordHash(s Store) error {
+	keys, err := s.Keys(EntryBucket)
+	if err != nil {
+		return err
+	}
+	b := NewBatch()
+	for _, key := range keys {
+		var entry map[string]json.RawMessage
+		if err := s.Get(EntryBucket, key, &entry); err != nil {
+			return err
+		}
+		if _, ok := entry["hash"]; ok || entry == nil {
+			continue
+		}
+		entry["hash"] = json.RawMessage(`"sha256"`)
+		if err := b.Set(EntryBucket, key, entry); err != nil {
+			return err
+		}
+	}
+	return s.Write(b)
+}
+
+// dropBlobCounts removes the bucket of the reference counts of the blobs added by version 2.
+// A JSON file drops the buckets it does not know when it is loaded.
+func dropBlobCounts(s Store) error {
+	if bs, ok := s.(*BoltStore); ok {
+		return bs.dropBucket("blobs")
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"time"
+)
+
+// defaultLockTimeout is how long Open waits for the lock of the state file held by another process.
+const defaultLockTimeout = 1 * time.Second
+
+type options struct {
+	migrate  bool
+	readOnly bool
+	timeout  time.Duration
+}
+
+// Option configures how a store is opened.
+type Option func(o *options)
+
+func newOptions(opts ...Option) *options {
+	o := &options{
+		migrate: true,
+		timeout: defaultLockTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithManualMigration leaves the pending migrations to Migrate, instead of applying them on open.
+func WithManualMigration() Option {
+	return func(o *options) {
+		o.migrate = false
+	}
+}
+
+// WithReadOnly opens the store for reading only. Readers share the lock of the state file with each other,
+// and a missing state file is read as an empty store. The migrations are not applied.
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithLockTimeout sets how long to wait for the lock of the state file held by another process.
+func WithLockTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
@@ -2,11 +2,12 @@ package store
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"slices"
-	"sync"
-	"time"
 
 	bolt "go.etcd.io/bbolt"
 
@@ -14,33 +15,79 @@ import (
 	"github.com/nishikirb/donut/system"
 )
 
-// // Store is an interface for storing and retrieving data.
-// type Store interface {
-// 	Get(bucket string, key string, value any) error
-// 	Set(bucket string, key string, value any) error
-// }
+// Store is an interface for storing and retrieving data.
+// Values are stored as JSON in buckets, and Get leaves value untouched if the key does not exist.
+type Store interface {
+	Get(bucket string, key string, value any) error
+	Set(bucket string, key string, value any) error
+	Delete(bucket string, key string) error
+	// Write writes all the changes of the batch, or none of them if it fails.
+	Write(b *Batch) error
+	// Keys returns the keys in the bucket in sorted order.
+	Keys(bucket string) ([]string, error)
+	// Clear removes all the values, keeping the buckets.
+	Clear() error
+	Close() error
+}
 
 // BoltStore is a Store implementation that uses BoltDB.
 type BoltStore struct {
-	db *bolt.DB
+	db       *bolt.DB
+	file     string
+	readOnly bool
 }
 
-const EntryBucket = "entries"
+var _ Store = (*BoltStore)(nil)
+
+// ErrBucketNotFound is returned when the bucket is not one of the buckets of the store.
+var ErrBucketNotFound = errors.New("bucket not found")
 
-var (
-	store   = &BoltStore{}
-	once    sync.Once
-	buckets = []string{EntryBucket}
+const (
+	EntryBucket    = "entries"
+	ExternalBucket = "externals"
+	// SumBucket caches the sums of the files with their stats, so that unchanged files are not hashed again.
+	SumBucket = "sums"
+	// MetaBucket holds the metadata of the store, such as the schema version. It is kept by Clear.
+	MetaBucket = "meta"
 )
 
-// Open opens a BoltDB database.
-func Open(file string) (*BoltStore, error) {
+var buckets = []string{EntryBucket, ExternalBucket, SumBucket, MetaBucket}
+
+// Open opens a BoltDB database, and applies the pending migrations unless WithManualMigration is given.
+// A *LockedError is returned if another process holds the lock of the file.
+func Open(file string, opts ...Option) (*BoltStore, error) {
+	return open(file, newOptions(opts...))
+}
+
+func open(file string, o *options) (*BoltStore, error) {
 	if err := system.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
 		return nil, err
 	}
 
-	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 1 * time.Second})
-	if err != nil {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: o.timeout, ReadOnly: o.readOnly})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, lockedError(file)
+	} else if err != nil {
+		return nil, err
+	}
+	s := &BoltStore{
+		db:       db,
+		file:     file,
+		readOnly: o.readOnly,
+	}
+
+	if o.readOnly {
+		// the buckets of a file written by an older version are created by a writer
+		if s.hasBuckets() {
+			return s, nil
+		}
+		db.Close()
+		o.readOnly = false
+		return open(file, o)
+	}
+
+	if err := writePID(file); err != nil {
+		db.Close()
 		return nil, err
 	}
 	if err := db.Update(func(tx *bolt.Tx) error {
@@ -51,26 +98,35 @@ func Open(file string) (*BoltStore, error) {
 		}
 		return nil
 	}); err != nil {
+		s.Close()
 		return nil, err
 	}
-
-	return &BoltStore{
-		db: db,
-	}, nil
+	if o.migrate {
+		if _, err := Migrate(s); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
-// Init initializes the store.
-func Init(file string) error {
-	var err error
-	once.Do(func() {
-		store, err = Open(file)
-	})
-	return err
+// OpenFile opens the store of the file. A file with the .json extension is opened as a JSONStore,
+// and any other file as a BoltStore.
+func OpenFile(file string, opts ...Option) (Store, error) {
+	if newOptions(opts...).readOnly {
+		if _, err := system.Stat(file); errors.Is(err, fs.ErrNotExist) {
+			return NewMemoryStore(), nil
+		}
+	}
+	if filepath.Ext(file) == ".json" {
+		return OpenJSON(file, opts...)
+	}
+	return Open(file, opts...)
 }
 
-// Get retrieves a value from the store.
-func Get(bucket string, key string, value any) error {
-	return store.Get(bucket, key, value)
+// Buckets returns the names of the buckets of the stores.
+func Buckets() []string {
+	return slices.Clone(buckets)
 }
 
 // Get retrieves a value from the store.
@@ -78,6 +134,9 @@ func (s *BoltStore) Get(bucket string, key string, value any) error {
 	var raw []byte
 	if err := s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return bucketNotFound(bucket)
+		}
 		raw = slices.Clone(b.Get([]byte(key)))
 		return nil
 	}); err != nil {
@@ -88,11 +147,6 @@ func (s *BoltStore) Get(bucket string, key string, value any) error {
 	return json.Unmarshal(raw, value)
 }
 
-// Set stores a value in the store.
-func Set(bucket string, key string, value any) error {
-	return store.Set(bucket, key, value)
-}
-
 // Set stores a value in the store.
 func (s *BoltStore) Set(bucket string, key string, value any) error {
 	raw, err := json.Marshal(value)
@@ -101,6 +155,9 @@ func (s *BoltStore) Set(bucket string, key string, value any) error {
 	}
 	if err := s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return bucketNotFound(bucket)
+		}
 		return b.Put([]byte(key), raw)
 	}); err != nil {
 		return err
@@ -108,9 +165,113 @@ func (s *BoltStore) Set(bucket string, key string, value any) error {
 	return nil
 }
 
+// Delete removes a value from the store.
+func (s *BoltStore) Delete(bucket string, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return bucketNotFound(bucket)
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// Write writes all the changes of the batch in a single transaction.
+func (s *BoltStore) Write(batch *Batch) error {
+	ops := batch.operations()
+	if len(ops) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range ops {
+			b := tx.Bucket([]byte(op.bucket))
+			if b == nil {
+				return bucketNotFound(op.bucket)
+			}
+			var err error
+			if op.raw == nil {
+				err = b.Delete([]byte(op.key))
+			} else {
+				err = b.Put([]byte(op.key), op.raw)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Keys returns the keys in the bucket.
+func (s *BoltStore) Keys(bucket string) ([]string, error) {
+	var keys []string
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return bucketNotFound(bucket)
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Clear removes all the values, keeping the buckets.
+func (s *BoltStore) Clear() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			if bucket == MetaBucket {
+				continue
+			}
+			if err := tx.DeleteBucket([]byte(bucket)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Close closes the store.
-func Close() error {
-	return store.db.Close()
+func (s *BoltStore) Close() error {
+	// the record of the holder is removed while the lock is still held
+	var err error
+	if !s.readOnly {
+		err = removePID(s.file)
+	}
+	return errors.Join(err, s.db.Close())
+}
+
+// hasBuckets reports whether all the buckets exist.
+func (s *BoltStore) hasBuckets() bool {
+	ok := true
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			ok = ok && tx.Bucket([]byte(bucket)) != nil
+		}
+		return nil
+	})
+	return ok
+}
+
+// dropBucket removes the bucket with its values, if it exists.
+func (s *BoltStore) dropBucket(bucket string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(bucket)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		return nil
+	})
+}
+
+func bucketNotFound(bucket string) error {
+	return fmt.Errorf("%s: %w", bucket, ErrBucketNotFound)
 }
 
 func DefaultDBFile() string {
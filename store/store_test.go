@@ -0,0 +1,241 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStore(t *testing.T) {
+	type value struct {
+		Name string `json:"name"`
+	}
+	tests := []struct {
+		name string
+		open func(t *testing.T, file string) (Store, error)
+		ext  string
+	}{
+		{
+			name: "Bolt",
+			open: func(_ *testing.T, file string) (Store, error) { return Open(file) },
+			ext:  ".db",
+		},
+		{
+			name: "Memory",
+			open: func(_ *testing.T, _ string) (Store, error) { return NewMemoryStore(), nil },
+		},
+		{
+			name: "JSON",
+			open: func(_ *testing.T, file string) (Store, error) { return OpenJSON(file) },
+			ext:  ".json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := tt.open(t, filepath.Join(t.TempDir(), "state"+tt.ext))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer s.Close()
+
+			var got *value
+			assert.NoError(t, s.Get(EntryBucket, "a", &got))
+			assert.Nil(t, got)
+
+			assert.NoError(t, s.Set(EntryBucket, "b", &value{Name: "b"}))
+			assert.NoError(t, s.Set(EntryBucket, "a", &value{Name: "a"}))
+			assert.NoError(t, s.Get(EntryBucket, "a", &got))
+			assert.Equal(t, &value{Name: "a"}, got)
+			keys, err := s.Keys(EntryBucket)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"a", "b"}, keys)
+
+			assert.NoError(t, s.Delete(EntryBucket, "a"))
+			keys, err = s.Keys(EntryBucket)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"b"}, keys)
+
+			assert.ErrorIs(t, s.Set("unknown", "a", &value{}), ErrBucketNotFound)
+
+			// a batch is written all or nothing
+			b := NewBatch()
+			assert.NoError(t, b.Set(EntryBucket, "c", &value{Name: "c"}))
+			b.Delete(EntryBucket, "b")
+			assert.NoError(t, b.Set("unknown", "a", &value{}))
+			assert.ErrorIs(t, s.Write(b), ErrBucketNotFound)
+			keys, err = s.Keys(EntryBucket)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"b"}, keys)
+
+			b = NewBatch()
+			assert.NoError(t, b.Set(EntryBucket, "c", &value{Name: "c"}))
+			b.Delete(EntryBucket, "b")
+			assert.Error(t, b.Set(EntryBucket, "d", func() {}))
+			assert.Equal(t, 2, b.Len())
+			assert.NoError(t, s.Write(b))
+			keys, err = s.Keys(EntryBucket)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"c"}, keys)
+
+			assert.NoError(t, s.Clear())
+			keys, err = s.Keys(EntryBucket)
+			assert.NoError(t, err)
+			assert.Empty(t, keys)
+		})
+	}
+}
+
+func TestOpenJSON(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	s, err := OpenJSON(file)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set(ExternalBucket, "https://example.com/a", map[string]string{"sum": "x"}))
+
+	raw, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(raw), `"https://example.com/a": {`)
+
+	// the values are kept across opens
+	assert.NoError(t, s.Close())
+	s, err = OpenJSON(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	var got map[string]string
+	assert.NoError(t, s.Get(ExternalBucket, "https://example.com/a", &got))
+	assert.Equal(t, map[string]string{"sum": "x"}, got)
+}
+
+func TestMigrate(t *testing.T) {
+	var applied []int
+	defer func(m []Migration) { migrations = m }(migrations)
+	migrations = []Migration{
+		{Version: 1, Migrate: func(Store) error { applied = append(applied, 1); return nil }},
+		{Version: 2, Migrate: func(s Store) error { applied = append(applied, 2); return s.Set(EntryBucket, "migrated", true) }},
+	}
+
+	s := NewMemoryStore()
+	assert.NoError(t, s.Set(MetaBucket, SchemaVersionKey, 1))
+	pending, err := Pending(s)
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	migrated, err := Migrate(s)
+	assert.NoError(t, err)
+	assert.Len(t, migrated, 1)
+	assert.Equal(t, []int{2}, applied)
+	v, err := Version(s)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v)
+	var ok bool
+	assert.NoError(t, s.Get(EntryBucket, "migrated", &ok))
+	assert.True(t, ok)
+
+	// the schema version is kept by Clear
+	assert.NoError(t, s.Clear())
+	v, err = Version(s)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v)
+
+	assert.NoError(t, s.Set(MetaBucket, SchemaVersionKey, SchemaVersion+1))
+	_, err = Migrate(s)
+	assert.ErrorContains(t, err, "newer than the supported version")
+}
+
+func TestRecordHash(t *testing.T) {
+	s := NewMemoryStore()
+	assert.NoError(t, s.Set(EntryBucket, "a", map[string]any{"sum": "eA=="}))
+	assert.NoError(t, s.Set(EntryBucket, "b", map[string]any{"sum": "eA==", "hash": "md5"}))
+	assert.NoError(t, recordHash(s))
+
+	for key, want := range map[string]string{"a": "sha256", "b": "md5"} {
+		var got map[string]any
+		assert.NoError(t, s.Get(EntryBucket, key, &got))
+		assert.Equal(t, want, got["hash"])
+	}
+}
+
+func TestDropBlobCounts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "donut.db")
+	s, err := Open(file, WithManualMigration())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	assert.NoError(t, s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("blobs"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("0a"), []byte("1"))
+	}))
+
+	assert.NoError(t, dropBlobCounts(s))
+	assert.NoError(t, s.db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte("blobs")))
+		return nil
+	}))
+	assert.NoError(t, dropBlobCounts(s))
+}
+
+func TestOpen_Locked(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "donut.db")
+	s, err := Open(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = open(file, &options{timeout: 10 * time.Millisecond})
+	var locked *LockedError
+	if assert.ErrorAs(t, err, &locked) {
+		assert.Equal(t, os.Getpid(), locked.PID)
+		assert.ErrorContains(t, err, fmt.Sprintf("another donut process (pid %d) holds the state lock", os.Getpid()))
+	}
+
+	assert.NoError(t, s.Close())
+	assert.NoFileExists(t, pidFile(file))
+	s, err = Open(file, WithReadOnly())
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+}
+
+func TestOpenJSON_Locked(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "donut.json")
+	s, err := OpenJSON(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, opts := range [][]Option{nil, {WithReadOnly()}} {
+		_, err = OpenJSON(file, append(opts, WithLockTimeout(10*time.Millisecond))...)
+		var locked *LockedError
+		if assert.ErrorAs(t, err, &locked) {
+			assert.Equal(t, os.Getpid(), locked.PID)
+		}
+	}
+
+	assert.NoError(t, s.Close())
+	assert.NoFileExists(t, pidFile(file))
+	r1, err := OpenJSON(file, WithReadOnly())
+	assert.NoError(t, err)
+	r2, err := OpenJSON(file, WithReadOnly(), WithLockTimeout(10*time.Millisecond))
+	assert.NoError(t, err, "the readers share the lock")
+	assert.NoError(t, r1.Close())
+	assert.NoError(t, r2.Close())
+}
+
+func TestOpenFile_ReadOnlyMissing(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "donut.db")
+	s, err := OpenFile(file, WithReadOnly())
+	assert.NoError(t, err)
+	keys, err := s.Keys(EntryBucket)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.NoFileExists(t, file)
+}
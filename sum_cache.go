@@ -0,0 +1,184 @@
+package donut
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nishikirb/donut/logger"
+	"github.com/nishikirb/donut/store"
+	"github.com/nishikirb/donut/system"
+)
+
+// racyWindow is how recently a file may be modified for its sum to be cached. A file modified
+// again within the resolution of the mtime keeps its stat, so the sum of a recent file may be stale.
+const racyWindow = 2 * time.Second
+
+// cachedSum is the sum of a file recorded with the stat of the file when it was hashed.
+type cachedSum struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Inode   uint64    `json:"inode"`
+	Sum     []byte    `json:"sum"`
+	Hash    string    `json:"hash"`
+}
+
+// matches reports whether the file of e has the recorded stat, and e uses the algorithm of the sum.
+func (c *cachedSum) matches(e *Entry) bool {
+	return c.Size == e.size && c.ModTime.Equal(e.ModTime) && c.Inode == e.inode && c.Hash == e.algorithm()
+}
+
+// sumCache reuses the sums of the regular files whose size, mtime and inode have not changed since
+// they were hashed. The sums are read from the store, and the new ones are written by flush.
+type sumCache struct {
+	store store.Store
+	// write writes the new sums, to the store by default
+	write func(b *store.Batch) error
+	// rehash is true if the cached sums are not used, but replaced by the computed ones
+	rehash  bool
+	mu      sync.Mutex
+	pending map[string]cachedSum
+}
+
+func newSumCache(s store.Store, rehash bool) *sumCache {
+	return &sumCache{
+		store:   s,
+		write:   s.Write,
+		rehash:  rehash,
+		pending: map[string]cachedSum{},
+	}
+}
+
+// sumCache returns the cache of the sums for a run, from the store if it is opened for the run.
+func (a *App) sumCache() (*sumCache, error) {
+	if a.store != nil {
+		return newSumCache(a.store, a.rehash), nil
+	}
+	return loadSumCache(a.statePath(), a.rehash, a.storeOpts...)
+}
+
+// loadSumCache reads the cached sums of the state file for the commands running without the store.
+// The file is shared with the other readers only while the sums are read, and the new sums are written
+// by flush in a short transaction of their own, so that the store is never held during the run.
+// The sums are neither read nor written while another process holds the lock.
+func loadSumCache(file string, rehash bool, opts ...store.Option) (*sumCache, error) {
+	s, err := store.OpenFile(file, append(slices.Clip(opts), store.WithReadOnly(), store.WithLockTimeout(time.Nanosecond))...)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	keys, err := s.Keys(store.SumBucket)
+	if err != nil {
+		return nil, err
+	}
+	b := store.NewBatch()
+	for _, key := range keys {
+		var raw json.RawMessage
+		if err := s.Get(store.SumBucket, key, &raw); err != nil {
+			return nil, err
+		}
+		if err := b.Set(store.SumBucket, key, raw); err != nil {
+			return nil, err
+		}
+	}
+	loaded := store.NewMemoryStore()
+	if err := loaded.Write(b); err != nil {
+		return nil, err
+	}
+
+	c := newSumCache(loaded, rehash)
+	c.write = func(b *store.Batch) error {
+		return writeSums(file, b, opts...)
+	}
+	return c, nil
+}
+
+// writeSums writes the sums of b to the state file, unless the file does not exist yet or is locked
+// by another process. The migrations are left to the commands using the store.
+func writeSums(file string, b *store.Batch, opts ...store.Option) error {
+	if _, err := system.Stat(file); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	s, err := store.OpenFile(file, append(slices.Clip(opts), store.WithManualMigration(), store.WithLockTimeout(time.Nanosecond))...)
+	var locked *store.LockedError
+	if errors.As(err, &locked) {
+		logger.Info().Str("state", file).Err(err).Msg("Skip sum cache")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return errors.Join(s.Write(b), s.Close())
+}
+
+// staleSums returns the paths of the cached sums whose files no longer exist.
+func (a *App) staleSums() ([]string, error) {
+	keys, err := a.store.Keys(store.SumBucket)
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for _, key := range keys {
+		if _, err := system.Lstat(key); errors.Is(err, fs.ErrNotExist) {
+			stale = append(stale, key)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return stale, nil
+}
+
+// lookup returns the cached sum of e, if the file of e is unchanged since it was hashed.
+func (c *sumCache) lookup(e *Entry) ([]byte, bool) {
+	if c == nil || c.rehash || !e.Mode.IsRegular() {
+		return nil, false
+	}
+	c.mu.Lock()
+	cs, ok := c.pending[e.Path]
+	c.mu.Unlock()
+	if !ok {
+		var stored *cachedSum
+		if err := c.store.Get(store.SumBucket, e.Path, &stored); err != nil || stored == nil {
+			return nil, false
+		}
+		cs = *stored
+	}
+	if !cs.matches(e) {
+		return nil, false
+	}
+	return cs.Sum, true
+}
+
+// add caches the sum of e computed from the file, unless the file was modified too recently.
+func (c *sumCache) add(e *Entry, sum []byte) {
+	if c == nil || !e.Mode.IsRegular() || time.Since(e.ModTime) < racyWindow {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[e.Path] = cachedSum{Size: e.size, ModTime: e.ModTime, Inode: e.inode, Sum: sum, Hash: e.algorithm()}
+}
+
+// flush writes the sums added since the last flush to the store.
+func (c *sumCache) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		return nil
+	}
+	b := store.NewBatch()
+	for path, cs := range c.pending {
+		if err := b.Set(store.SumBucket, path, cs); err != nil {
+			return err
+		}
+	}
+	if err := c.write(b); err != nil {
+		return err
+	}
+	logger.Info().Int("sums", len(c.pending)).Msg("Cache")
+	c.pending = map[string]cachedSum{}
+	return nil
+}
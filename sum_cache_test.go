@@ -0,0 +1,58 @@
+package donut
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nishikirb/donut/store"
+	"github.com/nishikirb/donut/test/helper"
+)
+
+func TestSumCache(t *testing.T) {
+	s := store.NewMemoryStore()
+	path := filepath.Join(t.TempDir(), ".vimrc")
+	old := time.Now().Add(-time.Hour)
+	write := func(content string, mtime time.Time) {
+		helper.WriteFile(t, path, []byte(content), 0644)
+		assert.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	sum := func(sums *sumCache) []byte {
+		e, err := NewEntry(path)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		e.sums = sums
+		got, err := e.GetSum()
+		assert.NoError(t, err)
+		return got
+	}
+	want := func(content string) []byte {
+		h := sha256.Sum256([]byte(content))
+		return h[:]
+	}
+
+	write("set number\n", old)
+	sums := newSumCache(s, false)
+	assert.Equal(t, want("set number\n"), sum(sums))
+	assert.NoError(t, sums.flush())
+
+	// the content is not read while the stat is unchanged
+	write("set nonumb\n", old)
+	assert.Equal(t, want("set number\n"), sum(newSumCache(s, false)))
+	assert.Equal(t, want("set nonumb\n"), sum(newSumCache(s, true)))
+
+	// a changed stat is hashed again
+	write("set nonumber\n", old)
+	assert.Equal(t, want("set nonumber\n"), sum(newSumCache(s, false)))
+
+	// a file modified too recently is not cached
+	write("set number\n", time.Now())
+	sums = newSumCache(s, false)
+	assert.Equal(t, want("set number\n"), sum(sums))
+	assert.Empty(t, sums.pending)
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package system
+
+import (
+	"io/fs"
+)
+
+// Inode returns the inode number of the file, or 0 if it is not known.
+func Inode(_ fs.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package system
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// Inode returns the inode number of the file, or 0 if it is not known.
+func Inode(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
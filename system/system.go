@@ -1,22 +1,38 @@
 package system
 
 import (
+	"context"
+	"io"
 	"io/fs"
+	"net/http"
 	"os"
 	"os/exec"
 
 	"github.com/google/renameio/v2"
+	"github.com/mattn/go-isatty"
 	"github.com/spf13/viper"
 
 	"github.com/nishikirb/donut/logger"
 )
 
 func MkdirAll(path string, perm fs.FileMode) error {
-	err := os.MkdirAll(path, os.ModePerm)
+	err := os.MkdirAll(path, perm)
 	logger.Info().Str("directory", path).Err(err).Msg("Create")
 	return err
 }
 
+func MkdirTemp(dir, pattern string) (string, error) {
+	name, err := os.MkdirTemp(dir, pattern)
+	logger.Info().Str("directory", name).Err(err).Msg("Create")
+	return name, err
+}
+
+func Chmod(name string, mode fs.FileMode) error {
+	err := os.Chmod(name, mode)
+	logger.Info().Str("entry", name).Str("mode", mode.String()).Err(err).Msg("Chmod")
+	return err
+}
+
 func Stat(name string) (fs.FileInfo, error) {
 	info, err := os.Stat(name)
 	logger.Info().Str("entry", name).Err(err).Msg("Stat")
@@ -47,6 +63,12 @@ func Remove(name string) error {
 	return err
 }
 
+func RemoveAll(path string) error {
+	err := os.RemoveAll(path)
+	logger.Info().Str("entry", path).Err(err).Msg("Remove")
+	return err
+}
+
 func Run(cmd *exec.Cmd) error {
 	err := cmd.Run()
 	logger.Info().Str("command", cmd.Path).Strs("args", cmd.Args[1:]).Err(err).Msg("Execute")
@@ -65,8 +87,57 @@ func Overwrite(filename string, data []byte, perm fs.FileMode, opts ...renameio.
 	return err
 }
 
+// OverwriteFrom replaces filename atomically with the data read from r, keeping the permission
+// of an existing file like Overwrite. If check is not nil, it is called after all data is written, and filename is left
+// untouched when it returns an error.
+func OverwriteFrom(filename string, r io.Reader, perm fs.FileMode, check func() error) error {
+	err := overwriteFrom(filename, r, perm, check)
+	logger.Info().Str("entry", filename).Err(err).Msg("Write")
+	return err
+}
+
+func overwriteFrom(filename string, r io.Reader, perm fs.FileMode, check func() error) error {
+	f, err := renameio.NewPendingFile(filename, renameio.WithPermissions(perm), renameio.WithExistingPermissions())
+	if err != nil {
+		return err
+	}
+	defer f.Cleanup()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return f.CloseAtomicallyReplace()
+}
+
+func HTTPGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	logger.Info().Str("url", url).Err(err).Msg("Fetch")
+	return resp, err
+}
+
 func WriteConfig(v *viper.Viper, path string) error {
 	err := v.SafeWriteConfigAs(path)
 	logger.Info().Str("entry", path).Err(err).Msg("Write")
 	return err
 }
+
+// IsTerminal reports whether w, or the writer it wraps, is a terminal.
+func IsTerminal(w io.Writer) bool {
+	if u, ok := w.(interface{ Unwrap() io.Writer }); ok {
+		w = u.Unwrap()
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
@@ -10,7 +10,21 @@ type templateParams struct {
 	Destination string
 }
 
-var tmpl = template.New("")
+func newTemplateParams(pm PathMapping) templateParams {
+	return templateParams{
+		Source:      pm.Source,
+		Destination: pm.Destination,
+	}
+}
+
+// argTemplates holds the parsed templates of each command, one template per argument
+// so that an argument containing spaces is never split.
+var argTemplates = map[string][]*template.Template{}
+
+var templateFuncs = template.FuncMap{
+	"shellquote": shellQuote,
+	"shelljoin":  shellJoin,
+}
 
 func createTemplateMap(tmap map[string][]string) error {
 	for name, args := range tmap {
@@ -22,9 +36,58 @@ func createTemplateMap(tmap map[string][]string) error {
 }
 
 func createTemplate(name string, args ...string) error {
-	joined := strings.Join(args, " ")
-	if _, err := tmpl.New(name).Parse(joined); err != nil {
-		return err
+	tmpls := make([]*template.Template, 0, len(args))
+	for _, arg := range args {
+		t, err := template.New(name).Funcs(templateFuncs).Parse(arg)
+		if err != nil {
+			return err
+		}
+		tmpls = append(tmpls, t)
 	}
+	argTemplates[name] = tmpls
 	return nil
 }
+
+// executeTemplate renders the arguments of the named command.
+func executeTemplate(name string, data any) ([]string, error) {
+	tmpls := argTemplates[name]
+	args := make([]string, 0, len(tmpls))
+	for _, t := range tmpls {
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		args = append(args, b.String())
+	}
+	return args, nil
+}
+
+// shellQuote quotes s for POSIX shells, for commands that are run with `sh -c` on purpose.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, needsQuote) == -1 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellJoin quotes each argument and joins them with spaces.
+func shellJoin(args ...string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+func needsQuote(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return false
+	case strings.ContainsRune("@%+=:,./_-", r):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package donut
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteTemplate(t *testing.T) {
+	data := templateParams{
+		Source:      "/home/user/.local/share/donut/my file",
+		Destination: "/home/user/it's here",
+	}
+
+	tests := []struct {
+		name      string
+		args      []string
+		want      []string
+		assertion assert.ErrorAssertionFunc
+	}{
+		{
+			name:      "OK/KeepSpaces",
+			args:      []string{"-upN", "{{.Destination}}", "{{.Source}}"},
+			want:      []string{"-upN", "/home/user/it's here", "/home/user/.local/share/donut/my file"},
+			assertion: assert.NoError,
+		},
+		{
+			name:      "OK/ShellQuote",
+			args:      []string{"-c", "cat {{.Source | shellquote}} | diff {{.Destination | shellquote}} -"},
+			want:      []string{"-c", `cat '/home/user/.local/share/donut/my file' | diff '/home/user/it'\''s here' -`},
+			assertion: assert.NoError,
+		},
+		{
+			name:      "OK/ShellJoin",
+			args:      []string{"{{shelljoin .Destination .Source}}"},
+			want:      []string{`'/home/user/it'\''s here' '/home/user/.local/share/donut/my file'`},
+			assertion: assert.NoError,
+		},
+		{
+			name:      "Error/Execute",
+			args:      []string{"{{.Unknown}}"},
+			want:      nil,
+			assertion: assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.NoError(t, createTemplate("test", tt.args...))
+			got, err := executeTemplate("test", data)
+			tt.assertion(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
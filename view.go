@@ -0,0 +1,17 @@
+package donut
+
+// View is the part of a destination file managed by donut, when donut does not manage the whole file.
+// Sums and diffs of the destination are computed on the view, so that changes outside of it are ignored.
+type View interface {
+	// Extract returns the managed part of content, and reports whether it was found.
+	Extract(content []byte) ([]byte, bool)
+	// Replace returns content whose managed part is replaced with source.
+	Replace(content, source []byte) ([]byte, error)
+	// Normalize returns source in the form returned by Extract, so that the two can be compared.
+	Normalize(source []byte) ([]byte, error)
+}
+
+var (
+	_ View = (*Block)(nil)
+	_ View = (*Patch)(nil)
+)
@@ -0,0 +1,280 @@
+package donut
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+
+	"github.com/nishikirb/donut/logger"
+	"github.com/nishikirb/donut/store"
+	"github.com/nishikirb/donut/system"
+)
+
+// defaultWatchDelay is the time to wait for further events before handling the changes.
+const defaultWatchDelay = 200 * time.Millisecond
+
+func (a *App) watch(ctx context.Context, _ []string, flags *pflag.FlagSet) error {
+	overwrite, _ := flags.GetBool("overwrite")
+	destinations, _ := flags.GetBool("destinations")
+	delay, err := flags.GetDuration("delay")
+	if err != nil || delay <= 0 {
+		delay = defaultWatchDelay
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if destinations {
+		return a.watchDestinations(ctx, w, delay)
+	}
+
+	if err := a.watchSource(w, a.config.Source); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "Watching: %s\n", a.config.Source)
+
+	return a.debounce(ctx, w, delay, func(paths []string) error {
+		// directories created after the start are watched as well
+		for _, path := range paths {
+			if info, err := system.Stat(path); err == nil && info.IsDir() {
+				if err := a.watchSource(w, path); err != nil {
+					return err
+				}
+			}
+		}
+		return a.withStore(ctx, false, func() error {
+			return a.applyPaths(ctx, paths, overwrite)
+		})
+	})
+}
+
+// withStore calls fn with the store opened, for the commands holding the store only while they change the state,
+// so that the other processes can use it in the meantime. The store given by WithStore is used as is.
+func (a *App) withStore(ctx context.Context, readOnly bool, fn func() error) (err error) {
+	if a.store != nil {
+		return fn()
+	}
+	opts := a.storeOpts
+	if readOnly {
+		opts = append(slices.Clip(opts), store.WithReadOnly())
+	}
+	if err := a.openStore(ctx, opts...); err != nil {
+		return err
+	}
+	defer func() { err = errors.Join(err, a.closeStore()) }()
+	return fn()
+}
+
+// watchDestinations reports the destinations recorded in the store that drift from the last
+// applied state, and when they are restored. The on_drift command is run for each drifted one.
+func (a *App) watchDestinations(ctx context.Context, w *fsnotify.Watcher, delay time.Duration) error {
+	var keys []string
+	if err := a.withStore(ctx, true, func() (err error) {
+		keys, err = a.store.Keys(store.EntryBucket)
+		return err
+	}); err != nil {
+		return err
+	}
+	mapper, err := a.pathMapper()
+	if err != nil {
+		return err
+	}
+	sources := make(map[string]string, len(mapper.Mapping))
+	for _, pm := range mapper.Mapping {
+		sources[pm.Destination] = pm.Source
+	}
+
+	// the parent directories are watched, as editors often replace files by renaming
+	var mappings []PathMapping
+	for _, dst := range keys {
+		dir := filepath.Dir(dst)
+		if !slices.Contains(w.WatchList(), dir) {
+			if err := w.Add(dir); err != nil {
+				fmt.Fprintf(a.err, "Failed: %s: %v\n", dir, err)
+				continue
+			}
+		}
+		mappings = append(mappings, PathMapping{Source: sources[dst], Destination: dst})
+	}
+	fmt.Fprintf(a.out, "Watching: %d destinations\n", len(mappings))
+
+	drifted := map[string]bool{}
+	check := func(targets []PathMapping) error {
+		var changed []PathMapping
+		if err := a.withStore(ctx, true, func() (err error) {
+			changed, err = a.checkDrift(targets, drifted)
+			return err
+		}); err != nil {
+			return err
+		}
+		// the command runs after the store is closed, as it may apply the destination
+		for _, pm := range changed {
+			if err := a.onDrift(ctx, pm); err != nil {
+				fmt.Fprintf(a.err, "Failed: %s: %v\n", pm.Destination, err)
+			}
+		}
+		return nil
+	}
+	if err := check(mappings); err != nil {
+		return err
+	}
+
+	return a.debounce(ctx, w, delay, func(paths []string) error {
+		var targets []PathMapping
+		for _, pm := range mappings {
+			if slices.Contains(paths, pm.Destination) {
+				targets = append(targets, pm)
+			}
+		}
+		return check(targets)
+	})
+}
+
+// checkDrift reports the targets that have drifted from or been restored to the last applied state
+// since the last check, updates drifted with their current state, and returns the drifted ones.
+func (a *App) checkDrift(targets []PathMapping, drifted map[string]bool) ([]PathMapping, error) {
+	var changed []PathMapping
+	for _, pm := range targets {
+		if _, err := entryCache.Reload(pm.Destination); err != nil {
+			return nil, err
+		}
+		modified, err := a.modified(pm.Destination)
+		if err != nil {
+			return nil, err
+		}
+		if modified == drifted[pm.Destination] {
+			continue
+		}
+		drifted[pm.Destination] = modified
+		if !modified {
+			fmt.Fprintf(a.out, "Restored: %s\n", pm.Destination)
+			continue
+		}
+		fmt.Fprintf(a.out, "Drifted: %s has been modified since the last apply\n", pm.Destination)
+		changed = append(changed, pm)
+	}
+	return changed, nil
+}
+
+// onDrift runs the on_drift command for pm, if configured.
+func (a *App) onDrift(ctx context.Context, pm PathMapping) error {
+	if len(a.config.OnDrift) == 0 {
+		return nil
+	}
+	args, err := executeTemplate("on_drift", newTemplateParams(pm))
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, a.config.OnDrift[0], args...)
+	cmd.Stdout = unwrap(a.out)
+	cmd.Stderr = unwrap(a.err)
+	return system.Run(cmd)
+}
+
+// watchSource adds root and its subdirectories in the source directory to w, except excluded ones.
+func (a *App) watchSource(w *fsnotify.Watcher, root string) error {
+	mapper := &PathMapper{excludes: append(slices.Clone(defaultExcludes), a.config.Excludes...)}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(a.config.Source, path)
+		if mapper.Excluded(rel) {
+			return fs.SkipDir
+		}
+		return w.Add(path)
+	})
+}
+
+// applyPaths applies the mappings whose source is one of paths or is under one of paths.
+func (a *App) applyPaths(ctx context.Context, paths []string, overwrite bool) error {
+	mapper, err := a.pathMapper()
+	if err != nil {
+		return err
+	}
+
+	var targets []PathMapping
+	for _, pm := range mapper.Mapping {
+		if !affected(pm.Source, paths) {
+			continue
+		}
+		// the cached entries are outdated by the change
+		if _, err := entryCache.Reload(pm.Source); err != nil {
+			return err
+		}
+		if _, err := entryCache.Reload(pm.Destination); err != nil {
+			return err
+		}
+		targets = append(targets, pm)
+	}
+
+	changes, err := a.changes(ctx, targets)
+	if err != nil {
+		return err
+	}
+	return a.batched(func() error {
+		return a.applyAll(ctx, changes, overwrite)
+	})
+}
+
+// debounce calls fn with the paths of the events received from w, once no event has been
+// received for the delay. Errors are reported and watching continues until ctx is done.
+func (a *App) debounce(ctx context.Context, w *fsnotify.Watcher, delay time.Duration, fn func(paths []string) error) error {
+	pending := map[string]struct{}{}
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			logger.Info().Str("entry", ev.Name).Str("op", ev.Op.String()).Msg("Watch")
+			pending[ev.Name] = struct{}{}
+			timer.Reset(delay)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(a.err, "Failed: %v\n", err)
+		case <-timer.C:
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			pending = map[string]struct{}{}
+			if err := fn(paths); err != nil {
+				fmt.Fprintf(a.err, "Failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// affected reports whether path is one of paths or is under one of them.
+func affected(path string, paths []string) bool {
+	for _, p := range paths {
+		if path == p || strings.HasPrefix(path, p+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
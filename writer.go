@@ -0,0 +1,39 @@
+package donut
+
+import (
+	"io"
+	"sync"
+)
+
+// lockedWriter serializes the writes of the concurrent workers, so that their lines never interleave.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newLockedWriter(w io.Writer) *lockedWriter {
+	if lw, ok := w.(*lockedWriter); ok {
+		return lw
+	}
+	return &lockedWriter{w: w}
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// Unwrap returns the underlying writer, e.g. to detect a terminal.
+func (l *lockedWriter) Unwrap() io.Writer {
+	return l.w
+}
+
+// unwrap returns the writer under the lockedWriter w, so that a child process is given the file itself,
+// such as the terminal, instead of a pipe.
+func unwrap(w io.Writer) io.Writer {
+	if lw, ok := w.(*lockedWriter); ok {
+		return lw.w
+	}
+	return w
+}
@@ -0,0 +1,146 @@
+// Package xxhash implements the 64-bit xxHash algorithm (XXH64), a fast non-cryptographic hash.
+package xxhash
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// the primes are variables, so that the initial state wraps around as unsigned integers
+var (
+	prime1 uint64 = 11400714785074694791
+	prime2 uint64 = 14029467366897019727
+	prime3 uint64 = 1609587929392839161
+	prime4 uint64 = 9650029242287828579
+	prime5 uint64 = 2870177450012600261
+)
+
+// Size is the size of the checksum in bytes.
+const Size = 8
+
+// BlockSize is the size of the stripes the input is processed in.
+const BlockSize = 32
+
+// Digest computes the XXH64 checksum of the data written to it, with the seed 0.
+type Digest struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	mem            [BlockSize]byte
+	n              int
+}
+
+var _ hash.Hash64 = (*Digest)(nil)
+
+// New returns a new Digest.
+func New() *Digest {
+	d := &Digest{}
+	d.Reset()
+	return d
+}
+
+// Sum64 returns the checksum of b.
+func Sum64(b []byte) uint64 {
+	d := New()
+	d.Write(b)
+	return d.Sum64()
+}
+
+// Reset resets the Digest to its initial state.
+func (d *Digest) Reset() {
+	d.v1 = prime1 + prime2
+	d.v2 = prime2
+	d.v3 = 0
+	d.v4 = -prime1
+	d.total = 0
+	d.n = 0
+}
+
+// Size returns the size of the checksum in bytes.
+func (d *Digest) Size() int { return Size }
+
+// BlockSize returns the size of the stripes the input is processed in.
+func (d *Digest) BlockSize() int { return BlockSize }
+
+// Write adds b to the data. It never returns an error.
+func (d *Digest) Write(b []byte) (int, error) {
+	n := len(b)
+	d.total += uint64(n)
+
+	if d.n+n < BlockSize {
+		d.n += copy(d.mem[d.n:], b)
+		return n, nil
+	}
+	if d.n > 0 {
+		c := copy(d.mem[d.n:], b)
+		d.stripe(d.mem[:])
+		b = b[c:]
+		d.n = 0
+	}
+	for ; len(b) >= BlockSize; b = b[BlockSize:] {
+		d.stripe(b)
+	}
+	d.n = copy(d.mem[:], b)
+	return n, nil
+}
+
+// stripe consumes the first BlockSize bytes of b.
+func (d *Digest) stripe(b []byte) {
+	d.v1 = round(d.v1, binary.LittleEndian.Uint64(b[0:8]))
+	d.v2 = round(d.v2, binary.LittleEndian.Uint64(b[8:16]))
+	d.v3 = round(d.v3, binary.LittleEndian.Uint64(b[16:24]))
+	d.v4 = round(d.v4, binary.LittleEndian.Uint64(b[24:32]))
+}
+
+// Sum appends the big-endian checksum to b.
+func (d *Digest) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, d.Sum64())
+}
+
+// Sum64 returns the checksum of the data written so far.
+func (d *Digest) Sum64() uint64 {
+	var h uint64
+	if d.total >= BlockSize {
+		h = bits.RotateLeft64(d.v1, 1) + bits.RotateLeft64(d.v2, 7) + bits.RotateLeft64(d.v3, 12) + bits.RotateLeft64(d.v4, 18)
+		h = mergeRound(h, d.v1)
+		h = mergeRound(h, d.v2)
+		h = mergeRound(h, d.v3)
+		h = mergeRound(h, d.v4)
+	} else {
+		h = d.v3 + prime5
+	}
+	h += d.total
+
+	b := d.mem[:d.n]
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= round(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*prime1 + prime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * prime1
+		h = bits.RotateLeft64(h, 23)*prime2 + prime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * prime5
+		h = bits.RotateLeft64(h, 11) * prime1
+	}
+
+	h ^= h >> 33
+	h *= prime2
+	h ^= h >> 29
+	h *= prime3
+	h ^= h >> 32
+	return h
+}
+
+func round(acc, input uint64) uint64 {
+	acc += input * prime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * prime1
+}
+
+func mergeRound(acc, val uint64) uint64 {
+	acc ^= round(0, val)
+	return acc*prime1 + prime4
+}
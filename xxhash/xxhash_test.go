@@ -0,0 +1,40 @@
+package xxhash
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSum64(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  uint64
+	}{
+		{name: "OK/Empty", input: "", want: 0xef46db3751d8e999},
+		{name: "OK/Byte", input: "a", want: 0xd24ec4f1a98c6e5b},
+		{name: "OK/Short", input: "asdf", want: 0x415872f599cea71e},
+		{name: "OK/Stripes", input: "Call me Ishmael. Some years ago--never mind how long precisely-", want: 0x02a2e85470d6fd96},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Sum64([]byte(tt.input)))
+
+			// the checksum does not depend on how the data is written
+			d := New()
+			for _, c := range []byte(tt.input) {
+				_, _ = d.Write([]byte{c})
+			}
+			assert.Equal(t, tt.want, d.Sum64())
+		})
+	}
+
+	long := []byte(strings.Repeat("donut ", 1000))
+	d := New()
+	_, _ = d.Write(long[:37])
+	_, _ = d.Write(long[37:])
+	assert.Equal(t, Sum64(long), d.Sum64())
+	assert.Len(t, d.Sum(nil), Size)
+}